@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+const cliUsage = `usage:
+  docker-registry-proxy cache list [-endpoint URL]
+  docker-registry-proxy cache purge [-endpoint URL] [-url URL] [-repository NAME] [-tag TAG] [-pattern GLOB] [-all]
+  docker-registry-proxy mode get [-endpoint URL]
+  docker-registry-proxy mode set [-endpoint URL] [-message MESSAGE] normal|read-only|maintenance
+
+the running instance is reached via the admin API, using DRP_ADMIN_LOGIN and DRP_ADMIN_PASSWORD
+`
+
+// cli runs the command line interface against the admin API of the running instance, returns the exit code
+func cli(cfg *config.Config, args []string) int {
+	if len(args) >= 2 && args[0] == "mode" {
+		return cliMode(cfg, args)
+	}
+	if len(args) < 2 || args[0] != "cache" {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	var method string
+	switch args[1] {
+	case "list":
+		method = http.MethodGet
+	case "purge":
+		method = http.MethodDelete
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)
+	endpoint := fs.String("endpoint", "http://127.0.0.1:"+cfg.Port, "base URL of the running instance")
+	filters := map[string]*string{}
+	var all *bool
+	if method == http.MethodDelete {
+		filters["url"] = fs.String("url", "", "purge by exact URL, e.g. /v2/foo/bar/tags/list")
+		filters["repository"] = fs.String("repository", "", "purge by repository name, e.g. foo/bar")
+		filters["tag"] = fs.String("tag", "", "purge by manifest reference, e.g. latest")
+		filters["pattern"] = fs.String("pattern", "", "purge by URL glob pattern, e.g. /v2/foo/*/tags/list")
+		all = fs.Bool("all", false, "purge everything")
+	}
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+
+	query := url.Values{}
+	for k, v := range filters {
+		if *v != "" {
+			query.Set(k, *v)
+		}
+	}
+	if all != nil && *all {
+		query.Set("all", strconv.FormatBool(*all))
+	}
+
+	return cliRequest(cfg, method, *endpoint+"/_admin/cache", query)
+}
+
+// cliMode gets or sets the mode of the running instance
+func cliMode(cfg *config.Config, args []string) int {
+	var method string
+	switch args[1] {
+	case "get":
+		method = http.MethodGet
+	case "set":
+		method = http.MethodPut
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)
+	endpoint := fs.String("endpoint", "http://127.0.0.1:"+cfg.Port, "base URL of the running instance")
+	var message *string
+	if method == http.MethodPut {
+		message = fs.String("message", "", "message of the rejected requests, the configured one is used if empty")
+	}
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+
+	query := url.Values{}
+	if method == http.MethodPut {
+		if fs.NArg() != 1 {
+			fmt.Fprint(os.Stderr, cliUsage)
+			return 2
+		}
+		query.Set("mode", fs.Arg(0))
+		if *message != "" {
+			query.Set("message", *message)
+		}
+	}
+
+	return cliRequest(cfg, method, *endpoint+"/_admin/mode", query)
+}
+
+// cliRequest sends the admin API request and prints the response body
+func cliRequest(cfg *config.Config, method, endpoint string, query url.Values) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+"?"+query.Encode(), http.NoBody)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.SetBasicAuth(cfg.Admin.Login, cfg.Admin.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body) //nolint:errcheck // nothing to do with it
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, resp.Status)
+		return 1
+	}
+	return 0
+}
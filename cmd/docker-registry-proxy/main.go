@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -33,6 +34,10 @@ func main() {
 	quit := make(chan struct{})
 
 	cfg := config.New()
+	if len(os.Args) > 1 {
+		os.Exit(cli(cfg, os.Args[1:]))
+	}
+
 	apm.SetName("drp")
 	// NOTE: due to the goroutine leak in sentry, it's disabled for now
 	// ref: https://github.com/getsentry/sentry-go/issues/731
@@ -66,8 +71,25 @@ func main() {
 		authProvider = services.NewAuthProvider(cfg.Allowed.Provider.URL, cfg.Allowed.Provider.Login, cfg.Allowed.Provider.Password)
 	}
 	authSvc := services.NewAuth(cfg.Allowed.IPs, cfg.Allowed.UAs, cfg.Trusted.IPs, cfg.Cache.TTL, cfg.Cache.Size, authProvider)
-	cacheSvc := services.NewCache(!cfg.Cache.Disabled, cfg.Cache.TTL, cfg.Cache.Size)
-	controllers.ConfigureRouter(e, cfg.Metrics, authSvc, cacheSvc, hc, cfg.Target)
+	for _, upstream := range cfg.Upstreams {
+		authSvc.AddUpstream(upstream.Name, upstream.AllowedIPs, upstream.AllowedUAs, upstream.TrustedIPs)
+	}
+	publicSvc := services.NewPublic(&cfg.Public, log)
+	upstreamsSvc := services.NewUpstreams(cfg.Upstreams, &cfg.Pool, &cfg.Retry, &cfg.Transport, log)
+	paginationSvc := services.NewPagination(&cfg.Pagination)
+	cacheSvc := services.NewCache(&cfg.Cache, log)
+	blobsSvc := services.NewBlobs(cfg.Blobs.Path, cfg.Blobs.Size, cfg.Cache.Partition, log)
+	modeSvc := services.NewMode(&cfg.Mode, log)
+	initModeSignals(modeSvc)
+	warmupSvc := services.NewWarmup(&cfg.Warmup, blobsSvc, log)
+	// nil *healthchecks.Client must not be passed as a non-nil interface
+	var hcSvc interface {
+		Fail(optionalBody ...io.Reader)
+	}
+	if hc != nil {
+		hcSvc = hc
+	}
+	controllers.ConfigureRouter(e, cfg.Metrics, cfg.Admin, publicSvc, upstreamsSvc, authSvc, paginationSvc, cacheSvc, blobsSvc, modeSvc, warmupSvc, hcSvc)
 
 	if err := e.Start(":" + cfg.Port); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Error().Err(err).Msg("http server failed")
@@ -88,6 +110,22 @@ func initShutdown(quit chan struct{}) {
 	}()
 }
 
+// initModeSignals toggles the read-only mode on SIGUSR1, and the maintenance mode on SIGUSR2
+func initModeSignals(modeSvc *services.Mode) {
+	listener := make(chan os.Signal, 1)
+	signal.Notify(listener, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range listener {
+			if sig == syscall.SIGUSR2 {
+				modeSvc.Toggle(services.ModeMaintenance)
+				continue
+			}
+			modeSvc.Toggle(services.ModeReadOnly)
+		}
+	}()
+}
+
 func shutdown(paniced bool) {
 	log.Info().Msg("Shutting down...")
 	defer sentry.Flush(5 * time.Second)
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"strconv"
+
 	echobasicauth "github.com/etkecc/go-echo-basic-auth"
 	"github.com/etkecc/go-env"
 )
@@ -13,11 +15,21 @@ type Config struct {
 	LogLevel     string              // log level
 	SentryDSN    string              // sentry dsn
 	Healthchecks Healthchecks        // healthchecks config
-	Target       Target              // target config
+	Target       Target              // target config, the only upstream if no upstreams are configured
+	Upstreams    []Upstream          // upstream registries config
+	Pool         Pool                // upstream pools config
+	Retry        Retry               // upstream retries config
+	Transport    Transport           // upstream connections config
 	Cache        Cache               // cache config
+	Blobs        Blobs               // blobs cache config
+	Warmup       Warmup              // cache warm-up config
+	Pagination   Pagination          // pagination config
 	Allowed      Allowed             // allowed ips and user agents (GET, HEAD, OPTIONS requests only)
 	Trusted      Trusted             // trusted ips (PATCH, POST, PUT, DELETE requests)
+	Public       Public              // public endpoint config
+	Mode         Mode                // read-only and maintenance modes config
 	Metrics      *echobasicauth.Auth // metrics basic auth
+	Admin        *echobasicauth.Auth // admin API basic auth, admin API is disabled if login or password is empty
 }
 
 // Healthchecks.io config
@@ -38,17 +50,152 @@ type Trusted struct {
 	IPs []string // static list of trusted IPs - requests from those IPS will be allowed
 }
 
+// Public endpoint config
+type Public struct {
+	URL     string   // public base URL of the proxy, e.g. https://registry.example.com, the request endpoint is used if empty
+	Proxies []string // trusted reverse proxies (IPs or CIDRs) in addition to loopback and private networks
+}
+
+// Mode config of the read-only and maintenance modes, switchable at runtime
+type Mode struct {
+	ReadOnly     bool     // start in the read-only mode
+	Maintenance  bool     // start in the maintenance mode
+	Message      string   // message of the rejected requests
+	Schedule     []string // maintenance windows in UTC, e.g. sun@02:00-04:00, or 03:00-03:30 for daily windows
+	ScheduleMode string   // mode during the maintenance windows: read-only or maintenance
+}
+
 // Cache config
 type Cache struct {
-	Disabled bool // cache disabled
-	TTL      int  // cache TTL in minutes
-	Size     int  // cache size
+	Disabled        bool // cache disabled
+	TTL             int  // cache TTL in minutes
+	Size            int  // auth cache size (amount of IPs)
+	Budget          int  // cache budget in megabytes
+	EntryMax        int  // max size of a cached response in kilobytes, larger responses are not cached
+	ImmutableTTL    int  // immutable (manifests by digest) cache TTL in minutes
+	ImmutableBudget int  // immutable (manifests by digest) cache budget in megabytes
+	TagsFreshness   int  // tag manifests freshness period in seconds, revalidated with the backend after it
+	Stale           int  // grace period in minutes to keep expired entries, served when the backend fails
+	StaleRevalidate int  // period in seconds after expiration to serve stale entries while refreshing them in the background
+
+	Rules          []CacheRule // custom cache rules, checked before the default rules
+	RulesNoDefault bool        // disable the default cache rules
+
+	Compression      string // cached bodies compression algorithm: gzip, deflate, or none
+	CompressionLevel int    // compression level, from 1 (best speed) to 9 (best compression), -1 for the default level
+
+	Partition bool     // partition the cache by client credentials (Authorization header), for backends with per-user permissions
+	Public    []string // names of the cache rules shared by all clients when the cache is partitioned, e.g. ping
+
+	Shared          string // shared cache server URL (redis protocol), e.g. redis://:password@host:6379/0, empty for local cache only
+	SharedNamespace string // shared cache keys namespace, to separate deployments using the same server
+}
+
+// CacheRule config
+type CacheRule struct {
+	Name     string
+	Methods  []string // http methods, default: GET
+	Path     string   // regular expression of the request path
+	Query    []string // allowed query params, "*" for any, empty for no query at all
+	Statuses []int    // cacheable response statuses, default: 200 204
+	TTL      int      // TTL in minutes, 0 for the cache TTL
+	Vary     []string // request headers included into the cache key, default: Accept
+}
+
+// Blobs cache config
+type Blobs struct {
+	Path string // path to the blobs storage directory, empty to disable
+	Size int    // disk budget in megabytes
+}
+
+// Warmup config
+type Warmup struct {
+	Images    []string // images to prefetch: repository with optional tag glob pattern, e.g. library/alpine:3.*, all tags by default
+	Interval  int      // prefetch interval in minutes, 0 to prefetch on startup only
+	Accept    []string // media types of the manifest requests' Accept header, should match the clients, as it's a part of the cache key
+	Platforms []string // platforms of multi-platform images to prefetch, e.g. linux/amd64, empty for all
+	Blobs     bool     // prefetch blobs (configs and layers) as well, requires the blobs cache
+}
+
+// Pagination config
+type Pagination struct {
+	Assemble bool // assemble full catalog and tag listings for clients that don't follow pagination
+	MaxPages int  // max amount of pages to assemble
 }
 
 // Target (backend) config
 type Target struct {
-	Scheme string
-	Host   string
+	Scheme  string
+	Host    string
+	Members []string // other replicas of the pool, the host is the first member
+	Balance string   // load-balancing strategy of the pool: round-robin, least-connections, or hash (by repository)
+
+	Username string // upstream registry credentials, the proxy authenticates itself instead of passing the client credentials
+	Password string
+
+	Hub bool // Docker Hub mirror mode: short names normalization, anonymous token auth, CDN redirects following, rate limits tracking
+
+	FollowRedirects bool     // follow the redirects of read requests (e.g. blobs in S3/GCS storage) instead of passing them to clients
+	RedirectHosts   []string // allowed redirect destinations, e.g. *.s3.amazonaws.com, empty for the upstream hosts
+
+	TLSCA         string // CA bundle file (PEM) to verify the upstream certificate, in addition to the system roots
+	TLSCert       string // client certificate file (PEM)
+	TLSKey        string // client certificate key file (PEM)
+	TLSServerName string // server name (SNI) to send and verify, e.g. when the host is an IP address
+	TLSMinVersion string // minimal TLS version: 1.0, 1.1, 1.2, or 1.3
+	TLSInsecure   bool   // skip the upstream certificate verification, for labs only
+}
+
+// Transport config of the upstream connections, applies to all upstreams
+type Transport struct {
+	Metadata Timeouts // API metadata requests: manifests, tags, catalog, etc.
+	Blob     Timeouts // blob downloads
+	Upload   Timeouts // write requests: uploads, pushes, deletions
+
+	MaxIdleConns        int  // max idle connections of the upstream
+	MaxIdleConnsPerHost int  // max idle connections per upstream host (pool member)
+	MaxConnsPerHost     int  // max connections per upstream host (pool member), 0 for unlimited
+	IdleConnTimeout     int  // idle connections are closed after this period in seconds
+	HTTP2Disabled       bool // disable HTTP/2 to upstreams (it's negotiated over TLS otherwise)
+	CancelOnDisconnect  bool // cancel the upstream read requests when the client disconnects
+}
+
+// Timeouts of an endpoint class in seconds, 0 for no timeout
+type Timeouts struct {
+	Connect int // connection establishment, including the TLS handshake
+	Header  int // response headers, after the request is written
+	Idle    int // response body, waiting for the upstream data
+}
+
+// Retry config of the idempotent upstream requests (GET, HEAD), applies to all upstreams
+type Retry struct {
+	Max        int   // max retries of a request, 0 to disable
+	Statuses   []int // retried response statuses, default: 502 503 504
+	Backoff    int   // initial backoff in milliseconds, doubled with each retry
+	BackoffMax int   // max backoff in milliseconds
+	Budget     int   // retries budget, percent of requests
+}
+
+// Pool config, applies to all upstreams with multiple members
+type Pool struct {
+	HealthInterval int // active health checks (GET /v2/) interval in seconds, 0 to disable
+	HealthTimeout  int // health check timeout in seconds
+	Failures       int // consecutive failures (connection errors and 5xx responses) to eject a member
+	Ejection       int // ejection period in seconds
+}
+
+// Upstream (backend registry) config
+type Upstream struct {
+	Name           string
+	Target         Target   // backend
+	Hosts          []string // request hosts routed to the upstream, e.g. ghcr.example.com
+	Prefix         string   // repository prefix routed to the upstream, stripped before proxying, e.g. ghcr for /v2/ghcr/foo/bar
+	UpstreamPrefix string   // repository prefix added before proxying, e.g. library for /v2/alpine -> /v2/library/alpine
+	AllowedIPs     []string // allowed IPs, overrides the global list if set
+	AllowedUAs     []string // allowed user agents' names, overrides the global list if set
+	TrustedIPs     []string // trusted IPs, overrides the global list if set
+	CacheDisabled  bool     // cache disabled for the upstream
+	CacheTTL       int      // cache TTL in minutes, 0 for the cache TTL
 }
 
 type AuthProvider struct {
@@ -60,6 +207,27 @@ type AuthProvider struct {
 // New config
 func New() *Config {
 	env.SetPrefix(prefix)
+	target := Target{
+		Scheme:  env.String("target.scheme"),
+		Host:    env.String("target.host"),
+		Members: env.Slice("target.members"),
+		Balance: env.String("target.balance", "round-robin"),
+
+		Username: env.String("target.username"),
+		Password: env.String("target.password"),
+
+		Hub: env.Bool("target.hub"),
+
+		FollowRedirects: env.Bool("target.redirects.follow"),
+		RedirectHosts:   env.Slice("target.redirects.hosts"),
+
+		TLSCA:         env.String("target.tls.ca"),
+		TLSCert:       env.String("target.tls.cert"),
+		TLSKey:        env.String("target.tls.key"),
+		TLSServerName: env.String("target.tls.servername"),
+		TLSMinVersion: env.String("target.tls.min.version"),
+		TLSInsecure:   env.Bool("target.tls.insecure"),
+	}
 
 	return &Config{
 		Port:      env.String("port", "8080"),
@@ -74,14 +242,71 @@ func New() *Config {
 			Password: env.String("metrics.password"),
 			IPs:      env.Slice("metrics.ips"),
 		},
-		Target: Target{
-			Scheme: env.String("target.scheme"),
-			Host:   env.String("target.host"),
+		Admin: &echobasicauth.Auth{
+			Login:    env.String("admin.login"),
+			Password: env.String("admin.password"),
+			IPs:      env.Slice("admin.ips"),
+		},
+		Target:    target,
+		Upstreams: upstreams(target),
+		Transport: Transport{
+			Metadata:            timeouts("metadata", 10, 30, 30),
+			Blob:                timeouts("blob", 10, 60, 60),
+			Upload:              timeouts("upload", 10, 300, 60),
+			MaxIdleConns:        env.Int("transport.max.idle", 100),
+			MaxIdleConnsPerHost: env.Int("transport.max.idle.per.host", 32),
+			MaxConnsPerHost:     env.Int("transport.max.per.host", 0),
+			IdleConnTimeout:     env.Int("transport.idle.timeout", 90),
+			HTTP2Disabled:       env.Bool("transport.http2.disabled"),
+			CancelOnDisconnect:  env.Bool("transport.cancel.on.disconnect"),
+		},
+		Retry: Retry{
+			Max:        env.Int("retry.max", 2),
+			Statuses:   ints(env.Slice("retry.statuses")),
+			Backoff:    env.Int("retry.backoff", 100),
+			BackoffMax: env.Int("retry.backoff.max", 2000),
+			Budget:     env.Int("retry.budget", 20),
+		},
+		Pool: Pool{
+			HealthInterval: env.Int("pool.health.interval", 10),
+			HealthTimeout:  env.Int("pool.health.timeout", 5),
+			Failures:       env.Int("pool.failures", 3),
+			Ejection:       env.Int("pool.ejection", 30),
 		},
 		Cache: Cache{
-			Disabled: env.Bool("cache.disabled"),
-			TTL:      env.Int("cache.ttl", 60),
-			Size:     env.Int("cache.size", 1000),
+			Disabled:         env.Bool("cache.disabled"),
+			TTL:              env.Int("cache.ttl", 60),
+			Size:             env.Int("cache.size", 1000),
+			Budget:           env.Int("cache.budget", 64),
+			EntryMax:         env.Int("cache.entry.max", 1024),
+			ImmutableTTL:     env.Int("cache.immutable.ttl", 10080),
+			ImmutableBudget:  env.Int("cache.immutable.budget", 64),
+			TagsFreshness:    env.Int("cache.tags.freshness", 30),
+			Stale:            env.Int("cache.stale", 60),
+			StaleRevalidate:  env.Int("cache.stale.revalidate", 0),
+			Rules:            cacheRules(),
+			RulesNoDefault:   env.Bool("cache.rules.nodefault"),
+			Compression:      env.String("cache.compression", "gzip"),
+			CompressionLevel: env.Int("cache.compression.level", -1),
+			Partition:        env.Bool("cache.partition"),
+			Public:           env.Slice("cache.public"),
+			Shared:           env.String("cache.shared"),
+			SharedNamespace:  env.String("cache.shared.namespace", "drp"),
+		},
+		Blobs: Blobs{
+			Path: env.String("blobs.path"),
+			Size: env.Int("blobs.size", 10240),
+		},
+		Warmup: Warmup{
+			Images:    env.Slice("warmup.images"),
+			Interval:  env.Int("warmup.interval", 0),
+			Accept:    env.Slice("warmup.accept"),
+			Platforms: env.Slice("warmup.platforms"),
+			Blobs:     env.Bool("warmup.blobs"),
+		},
+		Pagination: Pagination{
+			Assemble: env.Bool("pagination.assemble"),
+			MaxPages: env.Int("pagination.max.pages", 100),
 		},
 		Allowed: Allowed{
 			IPs: env.Slice("allowed.ips"),
@@ -95,5 +320,105 @@ func New() *Config {
 		Trusted: Trusted{
 			IPs: env.Slice("trusted.ips"),
 		},
+		Mode: Mode{
+			ReadOnly:     env.Bool("mode.read.only"),
+			Maintenance:  env.Bool("mode.maintenance"),
+			Message:      env.String("mode.message", "the registry is under maintenance, try again later"),
+			Schedule:     env.Slice("mode.schedule"),
+			ScheduleMode: env.String("mode.schedule.mode", "read-only"),
+		},
+		Public: Public{
+			URL:     env.String("public.url"),
+			Proxies: env.Slice("public.proxies"),
+		},
+	}
+}
+
+// cacheRules parses custom cache rules, e.g.:
+// DRP_CACHE_RULES="catalog referrers" with DRP_CACHE_RULE_CATALOG_PATH, DRP_CACHE_RULE_CATALOG_QUERY, etc.
+func cacheRules() []CacheRule {
+	names := env.Slice("cache.rules")
+	rules := make([]CacheRule, 0, len(names))
+	for _, name := range names {
+		key := "cache.rule." + name + "."
+		rules = append(rules, CacheRule{
+			Name:     name,
+			Methods:  env.Slice(key + "methods"),
+			Path:     env.String(key + "path"),
+			Query:    env.Slice(key + "query"),
+			Statuses: ints(env.Slice(key + "statuses")),
+			TTL:      env.Int(key + "ttl"),
+			Vary:     env.Slice(key + "vary"),
+		})
+	}
+	return rules
+}
+
+// upstreams parses the upstream registries, e.g.:
+// DRP_UPSTREAMS="hub ghcr" with DRP_UPSTREAM_HUB_HOST, DRP_UPSTREAM_HUB_PREFIX, etc.
+// The target is the only upstream if no upstreams are configured
+func upstreams(target Target) []Upstream {
+	names := env.Slice("upstreams")
+	if len(names) == 0 {
+		return []Upstream{{Name: "default", Target: target}}
+	}
+
+	list := make([]Upstream, 0, len(names))
+	for _, name := range names {
+		key := "upstream." + name + "."
+		list = append(list, Upstream{
+			Name: name,
+			Target: Target{
+				Scheme:  env.String(key+"scheme", "https"),
+				Host:    env.String(key + "host"),
+				Members: env.Slice(key + "members"),
+				Balance: env.String(key+"balance", "round-robin"),
+
+				Username: env.String(key + "username"),
+				Password: env.String(key + "password"),
+
+				Hub: env.Bool(key + "hub"),
+
+				FollowRedirects: env.Bool(key + "redirects.follow"),
+				RedirectHosts:   env.Slice(key + "redirects.hosts"),
+
+				TLSCA:         env.String(key + "tls.ca"),
+				TLSCert:       env.String(key + "tls.cert"),
+				TLSKey:        env.String(key + "tls.key"),
+				TLSServerName: env.String(key + "tls.servername"),
+				TLSMinVersion: env.String(key + "tls.min.version"),
+				TLSInsecure:   env.Bool(key + "tls.insecure"),
+			},
+			Hosts:          env.Slice(key + "hosts"),
+			Prefix:         env.String(key + "prefix"),
+			UpstreamPrefix: env.String(key + "upstream.prefix"),
+			AllowedIPs:     env.Slice(key + "allowed.ips"),
+			AllowedUAs:     env.Slice(key + "allowed.uas"),
+			TrustedIPs:     env.Slice(key + "trusted.ips"),
+			CacheDisabled:  env.Bool(key + "cache.disabled"),
+			CacheTTL:       env.Int(key+"cache.ttl", 0),
+		})
+	}
+	return list
+}
+
+// timeouts parses the timeouts of the endpoint class, e.g. DRP_TIMEOUT_BLOB_IDLE
+func timeouts(class string, connect, header, idle int) Timeouts {
+	key := "timeout." + class + "."
+	return Timeouts{
+		Connect: env.Int(key+"connect", connect),
+		Header:  env.Int(key+"header", header),
+		Idle:    env.Int(key+"idle", idle),
+	}
+}
+
+// ints converts a slice of strings to ints, skipping invalid values
+func ints(slice []string) []int {
+	result := make([]int, 0, len(slice))
+	for _, s := range slice {
+		if i, err := strconv.Atoi(s); err == nil {
+			result = append(result, i)
+		}
 	}
+	return result
 }
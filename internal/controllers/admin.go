@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/etkecc/docker-registry-proxy/internal/errors"
+	"github.com/etkecc/docker-registry-proxy/internal/services"
+)
+
+type cacheAdminService interface {
+	Entries() []services.CacheEntry
+	Purge(filter services.CachePurge) int
+}
+
+type modeAdminService interface {
+	State() services.ModeState
+	Set(mode, message string) error
+}
+
+// modeGet returns the current mode
+func modeGet(modeSvc modeAdminService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, modeSvc.State())
+	}
+}
+
+// modeSet sets the mode from the query params: mode and optional message
+func modeSet(modeSvc modeAdminService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := modeSvc.Set(c.QueryParam("mode"), c.QueryParam("message")); err != nil {
+			return c.JSON(http.StatusBadRequest, errors.NewResponse(http.StatusBadRequest, err.Error()))
+		}
+		return c.JSON(http.StatusOK, modeSvc.State())
+	}
+}
+
+// cacheList returns all cached entries
+func cacheList(cacheSvc cacheAdminService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cacheSvc.Entries())
+	}
+}
+
+// cachePurge removes cached entries matching the query filter
+func cachePurge(cacheSvc cacheAdminService) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var filter services.CachePurge
+		if err := (&echo.DefaultBinder{}).BindQueryParams(c, &filter); err != nil {
+			return c.JSON(http.StatusBadRequest, errors.NewResponse(http.StatusBadRequest, err.Error()))
+		}
+		if filter.IsEmpty() {
+			return c.JSON(http.StatusBadRequest, errors.NewResponse(http.StatusBadRequest, "at least one of url, repository, tag, pattern or all must be set"))
+		}
+		purged := cacheSvc.Purge(filter)
+		return c.JSON(http.StatusOK, map[string]int{"purged": purged})
+	}
+}
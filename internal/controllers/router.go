@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/etkecc/go-apm"
@@ -15,25 +16,48 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog"
 
-	"github.com/etkecc/docker-registry-proxy/internal/config"
 	"github.com/etkecc/docker-registry-proxy/internal/errors"
 	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+	"github.com/etkecc/docker-registry-proxy/internal/services"
 	"github.com/etkecc/docker-registry-proxy/internal/utils"
 )
 
-var httpTransport http.RoundTripper
+var (
+	// linkURL matches URLs in the Link header, e.g. </v2/_catalog?last=a&n=1>; rel="next"
+	linkURL = regexp.MustCompile(`<[^>]*>`)
+	// challengeRealm matches the realm of the WWW-Authenticate header, e.g. Bearer realm="https://backend/token",service="registry"
+	challengeRealm = regexp.MustCompile(`realm="[^"]*"`)
+)
 
 type echoService interface {
 	Middleware() echo.MiddlewareFunc
 }
 
+type cacheService interface {
+	echoService
+	cacheAdminService
+}
+
+type warmupService interface {
+	Start(e *echo.Echo, handler echo.HandlerFunc)
+}
+
 type healthchecksService interface {
 	Fail(optionalBody ...io.Reader)
 }
 
+type modeService interface {
+	echoService
+	modeAdminService
+}
+
+type publicService interface {
+	echoService
+	TrustOptions() []echo.TrustOption
+}
+
 // ConfigureRouter configures echo router
-func ConfigureRouter(e *echo.Echo, metricsAuth *echobasicauth.Auth, authSvc, cacheSvc echoService, hcSvc healthchecksService, target config.Target) {
-	httpTransport = apm.WrapRoundTripper(http.DefaultTransport, apm.WithMaxRetries(0))
+func ConfigureRouter(e *echo.Echo, metricsAuth, adminAuth *echobasicauth.Auth, publicSvc publicService, upstreamsSvc, authSvc, paginationSvc echoService, cacheSvc cacheService, blobsSvc echoService, modeSvc modeService, warmupSvc warmupService, hcSvc healthchecksService) {
 	e.Use(middleware.Recover())
 	e.Use(middleware.Secure())
 	e.Use(apm.WithSentry())
@@ -44,56 +68,168 @@ func ConfigureRouter(e *echo.Echo, metricsAuth *echobasicauth.Auth, authSvc, cac
 		}
 	})
 	e.HideBanner = true
-	e.IPExtractor = echo.ExtractIPFromXFFHeader(
+	e.IPExtractor = echo.ExtractIPFromXFFHeader(append([]echo.TrustOption{
 		echo.TrustLoopback(true),
 		echo.TrustLinkLocal(true),
 		echo.TrustPrivateNet(true),
-	)
+	}, publicSvc.TrustOptions()...)...)
 	metricsAuthMiddleware := echobasicauth.NewMiddleware(metricsAuth)
 	e.GET("/_health", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+		return c.JSON(http.StatusOK, map[string]any{"status": "ok", "mode": modeSvc.State()})
 	})
 	e.GET("/metrics", metrics.Handler(), metricsAuthMiddleware)
 
-	e.Any("*", proxy(target, hcSvc), authSvc.Middleware(), cacheSvc.Middleware())
+	if adminAuth.Login != "" && adminAuth.Password != "" {
+		admin := e.Group("/_admin", echobasicauth.NewMiddleware(adminAuth))
+		admin.GET("/cache", cacheList(cacheSvc))
+		admin.DELETE("/cache", cachePurge(cacheSvc))
+		admin.GET("/mode", modeGet(modeSvc))
+		admin.PUT("/mode", modeSet(modeSvc))
+	}
+
+	handler := proxy(hcSvc)
+	e.Any("*", handler, publicSvc.Middleware(), upstreamsSvc.Middleware(), authSvc.Middleware(), paginationSvc.Middleware(), cacheSvc.Middleware(), blobsSvc.Middleware(), modeSvc.Middleware())
+	warmupSvc.Start(e, upstreamsSvc.Middleware()(cacheSvc.Middleware()(blobsSvc.Middleware()(modeSvc.Middleware()(handler)))))
 }
 
-func proxy(target config.Target, hcSvc healthchecksService) echo.HandlerFunc {
+// proxy passes the request to the upstream resolved by the upstreams middleware.
+// Read requests failed with connection errors or 5xx responses are retried with other members of the upstream pool
+func proxy(hcSvc healthchecksService) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		upstream := services.UpstreamOf(c)
+		if upstream == nil {
+			utils.NewLog(c).Error().Msg("request is not routed to any upstream")
+			return c.JSON(http.StatusBadGateway, errors.NewResponse(http.StatusBadGateway))
+		}
 		ctx := c.Request().Context()
-		ctx = context.WithoutCancel(ctx)
+		if upstream.Detached(c.Request()) {
+			ctx = context.WithoutCancel(ctx)
+		}
 		ctx = apm.NewContext(ctx)
 		c.SetRequest(c.Request().WithContext(ctx))
 
 		src := *c.Request().URL
-		src.Host = c.Request().Host
+		public := services.PublicOf(c)
 		log := utils.NewLog(c)
-		c.Request().Host = target.Host
-
-		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Host: target.Host, Scheme: target.Scheme})
-		proxy.Transport = httpTransport
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) { proxyError(w, r, hcSvc, err) }
-		proxy.ModifyResponse = func(r *http.Response) error {
-			// rewrite location header if needed
-			if location := r.Header.Get("Location"); location != "" {
-				locationURL, err := url.Parse(location)
-				if err == nil && locationURL.Host == target.Host {
-					locationURL.Host = src.Host
-				}
-				r.Header.Set("Location", locationURL.String())
+		c.Request().URL.Path = upstream.UpstreamPath(src.Path)
+		c.Request().URL.RawPath = ""
+
+		// echo.Response keeps track of the status, even if the response was written by the proxy error handler
+		defer proxyRecover(ctx, c.Response(), hcSvc)
+		defer func() { c.Request().URL.Path = src.Path }() // the cache and logs use the client-facing path
+
+		read := c.Request().Method == http.MethodGet || c.Request().Method == http.MethodHead
+		tried := map[*services.UpstreamMember]bool{}
+		for member := upstream.Pick(c.Request(), tried); member != nil; member = upstream.Pick(c.Request(), tried) {
+			tried[member] = true
+			failover := read && upstream.CanFailover(tried)
+			if !proxyMember(c, upstream, member, public, failover, hcSvc, log) {
+				return nil
 			}
-			c.Set("resp.status", r.StatusCode)
-			log.Info().
-				Int("resp.status", r.StatusCode).
-				Str("req.url", r.Request.URL.String()).
-				Msg("proxied")
+			log.Warn().Str("upstream", upstream.Name).Str("member", member.Host).Msg("failed, trying another upstream member")
+			go metrics.Failover()
+		}
+
+		// no member is available: the pool is empty, or the failover member was ejected meanwhile
+		if fallback, ok := c.Get("proxy.fallback").(func()); ok {
+			fallback()
 			return nil
 		}
+		proxyError(c.Response(), c.Request(), hcSvc, fmt.Errorf("no member of the upstream %s is available", upstream.Name))
+		return nil
+	}
+}
+
+// proxyMember passes the request to the upstream pool member, returns true if the request failed and should be retried
+// with another member (failover is allowed, and nothing was written to the client)
+func proxyMember(c echo.Context, upstream *services.Upstream, member *services.UpstreamMember, public *url.URL, failover bool, hcSvc healthchecksService, log *zerolog.Logger) bool {
+	target := upstream.Target
+	c.Request().Host = member.Host
 
-		defer proxyRecover(ctx, c.Response().Writer, hcSvc)
-		proxy.ServeHTTP(c.Response().Writer, c.Request())
+	// fallback is set by the cache to serve a stale response when the backend fails
+	fallback, _ := c.Get("proxy.fallback").(func())
+
+	var ok, retry bool
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Host: member.Host, Scheme: target.Scheme})
+	proxy.Transport = upstream.Transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		ok = false
+		if failover {
+			log.Warn().Err(err).Str("member", member.Host).Msg("upstream member failed")
+			retry = true
+			return
+		}
+		if fallback != nil {
+			log.Warn().Err(err).Msg("failed, using fallback")
+			fallback()
+			return
+		}
+		proxyError(w, r, hcSvc, err)
+	}
+	proxy.ModifyResponse = func(r *http.Response) error {
+		ok = r.StatusCode < http.StatusInternalServerError
+		if (failover || fallback != nil) && !ok {
+			return fmt.Errorf("backend responded with %s", r.Status)
+		}
+		// rewrite location header (redirects, upload URLs) if needed
+		if location := r.Header.Get("Location"); location != "" {
+			r.Header.Set("Location", rewriteURL(location, upstream, public))
+		}
+		// rewrite link header (pagination) if needed
+		if link := r.Header.Get("Link"); link != "" {
+			r.Header.Set("Link", rewriteLink(link, upstream, public))
+		}
+		// rewrite the auth challenge realm, if the upstream serves the tokens itself
+		for i, challenge := range r.Header.Values("WWW-Authenticate") {
+			r.Header["Www-Authenticate"][i] = rewriteRealm(challenge, upstream, public)
+		}
+		c.Set("resp.status", r.StatusCode)
+		log.Info().
+			Str("upstream", upstream.Name).
+			Int("resp.status", r.StatusCode).
+			Str("req.url", r.Request.URL.String()).
+			Msg("proxied")
 		return nil
 	}
+
+	upstream.Start(member)
+	defer func() { upstream.Done(member, ok) }()
+	proxy.ServeHTTP(c.Response(), c.Request())
+	return retry
+}
+
+// rewriteURL replaces the upstream scheme, host and path with the public ones in the response header URL,
+// e.g. http://10.0.0.5:5000/v2/library/alpine/blobs/uploads/uuid -> https://registry.example.com/v2/hub/alpine/blobs/uploads/uuid.
+// Relative URLs get the client-facing path only, URLs of other hosts (e.g. storage) are kept as is
+func rewriteURL(raw string, upstream *services.Upstream, public *url.URL) string {
+	rawURL, err := url.Parse(raw)
+	if err != nil || (rawURL.Host != "" && !upstream.Internal(rawURL.Host)) {
+		return raw
+	}
+	if rawURL.Host != "" {
+		rawURL.Scheme = public.Scheme
+		rawURL.Host = public.Host
+	}
+	if strings.HasPrefix(rawURL.Path, "/") {
+		rawURL.Path = public.Path + upstream.ClientPath(rawURL.Path)
+		rawURL.RawPath = ""
+	}
+	return rawURL.String()
+}
+
+// rewriteLink rewrites the Link header URLs, e.g. <https://backend/v2/library/alpine/tags/list?last=a&n=1>; rel="next"
+func rewriteLink(link string, upstream *services.Upstream, public *url.URL) string {
+	return linkURL.ReplaceAllStringFunc(link, func(match string) string {
+		return "<" + rewriteURL(strings.Trim(match, "<>"), upstream, public) + ">"
+	})
+}
+
+// rewriteRealm rewrites the WWW-Authenticate realm URL, e.g. Bearer realm="https://backend/token",service="registry"
+func rewriteRealm(challenge string, upstream *services.Upstream, public *url.URL) string {
+	return challengeRealm.ReplaceAllStringFunc(challenge, func(match string) string {
+		realm := strings.TrimSuffix(strings.TrimPrefix(match, `realm="`), `"`)
+		return `realm="` + rewriteURL(realm, upstream, public) + `"`
+	})
 }
 
 func proxyError(w http.ResponseWriter, r *http.Request, hcSvc healthchecksService, err error) {
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/services"
+)
+
+func TestProxyRewritesHeaders(t *testing.T) {
+	log := zerolog.Nop()
+	var backendURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/alpine/tags/list":
+			w.Header().Set("Link", "<"+backendURL+`/v2/library/alpine/tags/list?last=a&n=1>; rel="next"`)
+		case "/v2/library/alpine/blobs/uploads/":
+			w.Header().Set("Location", backendURL+"/v2/library/alpine/blobs/uploads/uuid?_state=x")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case "/v2/library/alpine/blobs/sha256:blob":
+			w.Header().Set("Location", "https://storage.example.com/presigned?X-Amz-Signature=x")
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+backendURL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`)) //nolint:errcheck // test server
+	}))
+	defer backend.Close()
+	backendURL = backend.URL
+
+	upstreams := services.NewUpstreams([]config.Upstream{{
+		Name:           "hub",
+		Prefix:         "hub",
+		UpstreamPrefix: "library",
+		Target:         config.Target{Scheme: "http", Host: strings.TrimPrefix(backend.URL, "http://")},
+	}}, &config.Pool{}, &config.Retry{}, &config.Transport{}, &log)
+	public := services.NewPublic(&config.Public{}, &log)
+	handler := public.Middleware()(upstreams.Middleware()(proxy(nil)))
+
+	tests := []struct {
+		method string
+		path   string
+		header string
+		value  string
+	}{
+		{http.MethodGet, "/v2/hub/alpine/tags/list", "Link", `<https://registry.example.com/v2/hub/alpine/tags/list?last=a&n=1>; rel="next"`},
+		{http.MethodPost, "/v2/hub/alpine/blobs/uploads/", "Location", "https://registry.example.com/v2/hub/alpine/blobs/uploads/uuid?_state=x"},
+		{http.MethodGet, "/v2/hub/alpine/blobs/sha256:blob", "Location", "https://storage.example.com/presigned?X-Amz-Signature=x"},
+		{http.MethodGet, "/v2/", "WWW-Authenticate", `Bearer realm="https://registry.example.com/token",service="registry"`},
+	}
+	e := echo.New()
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, http.NoBody)
+		req.RemoteAddr = "127.0.0.1:12345" // trusted proxy
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "registry.example.com")
+		rec := httptest.NewRecorder()
+		handler(e.NewContext(req, rec)) //nolint:errcheck // the errors are written to the response
+
+		if value := rec.Header().Get(test.header); value != test.value {
+			t.Errorf("%s %s: %s is %s, expected %s", test.method, test.path, test.header, value, test.value)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/labstack/echo/v4"
@@ -15,6 +16,41 @@ var (
 
 	cacheHit  = metrics.NewCounter("drp_cache_hits")
 	cacheMiss = metrics.NewCounter("drp_cache_misses")
+	coalesced = metrics.NewCounter("drp_cache_coalesced")
+	rejected  = metrics.NewCounter("drp_cache_rejected")
+
+	notModified = metrics.NewCounter("drp_cache_not_modified")
+
+	compressionRaw    = metrics.NewCounter("drp_cache_compression_raw_bytes")
+	compressionStored = metrics.NewCounter("drp_cache_compression_stored_bytes")
+	_                 = metrics.NewGauge("drp_cache_compression_ratio", func() float64 {
+		if compressionStored.Get() == 0 {
+			return 0
+		}
+		return float64(compressionRaw.Get()) / float64(compressionStored.Get())
+	})
+
+	staleError      = metrics.NewCounter(`drp_cache_stale{reason="error"}`)
+	staleRevalidate = metrics.NewCounter(`drp_cache_stale{reason="revalidate"}`)
+
+	invalidated = metrics.NewCounter("drp_cache_invalidated")
+
+	sharedErrors = metrics.NewCounter("drp_cache_shared_errors")
+
+	revalidationsUnchanged = metrics.NewCounter(`drp_cache_revalidations{result="unchanged"}`)
+	revalidationsChanged   = metrics.NewCounter(`drp_cache_revalidations{result="changed"}`)
+
+	warmupOK       = metrics.NewCounter(`drp_warmup_requests{result="ok"}`)
+	warmupFailed   = metrics.NewCounter(`drp_warmup_requests{result="failed"}`)
+	warmupLastRun  = metrics.NewGauge("drp_warmup_last_run_timestamp", nil)
+	warmupDuration = metrics.NewGauge("drp_warmup_last_run_duration_seconds", nil)
+
+	failovers = metrics.NewCounter("drp_upstream_failovers")
+
+	blobsHit   = metrics.NewCounter("drp_blobs_hits")
+	blobsMiss  = metrics.NewCounter("drp_blobs_misses")
+	blobsCount = metrics.NewGauge("drp_blobs_count", nil)
+	blobsBytes = metrics.NewGauge("drp_blobs_bytes", nil)
 
 	notImages = map[string]bool{
 		"":         true,
@@ -105,3 +141,123 @@ func Cache(hit bool) {
 		cacheMiss.Inc()
 	}
 }
+
+// CacheRejected increments the counter of responses that were not admitted to the cache (too large or too rare)
+func CacheRejected() {
+	rejected.Inc()
+}
+
+// CacheStats registers the cache store gauges: amount of entries and their total size in bytes
+func CacheStats(store string, stats func() (int, int64)) {
+	metrics.GetOrCreateGauge(fmt.Sprintf("drp_cache_entries{store=%q}", store), func() float64 {
+		entries, _ := stats()
+		return float64(entries)
+	})
+	metrics.GetOrCreateGauge(fmt.Sprintf("drp_cache_bytes{store=%q}", store), func() float64 {
+		_, size := stats()
+		return float64(size)
+	})
+}
+
+// Stale increments the stale responses counter, labeled by the reason: backend error or background revalidation
+func Stale(backendError bool) {
+	if backendError {
+		staleError.Inc()
+	} else {
+		staleRevalidate.Inc()
+	}
+}
+
+// NotModified increments the counter of conditional requests answered with 304 Not Modified from the cache
+func NotModified() {
+	notModified.Inc()
+}
+
+// Compression adds the raw and compressed sizes of the cached body, the ratio of their totals is the compression ratio
+func Compression(raw, stored int) {
+	compressionRaw.Add(raw)
+	compressionStored.Add(stored)
+}
+
+// Coalesced increments the coalesced requests counter
+func Coalesced() {
+	coalesced.Inc()
+}
+
+// Invalidated increments the invalidated cache entries counter
+func Invalidated(count int) {
+	invalidated.Add(count)
+}
+
+// SharedCacheError increments the shared cache errors counter
+func SharedCacheError() {
+	sharedErrors.Inc()
+}
+
+// Revalidation increments the cache revalidations counter, labeled by the result
+func Revalidation(changed bool) {
+	if changed {
+		revalidationsChanged.Inc()
+	} else {
+		revalidationsUnchanged.Inc()
+	}
+}
+
+// Blobs increments the blobs cache hits or misses counter
+func Blobs(hit bool) {
+	if hit {
+		blobsHit.Inc()
+	} else {
+		blobsMiss.Inc()
+	}
+}
+
+// BlobsSize sets the amount of cached blobs and their total size in bytes
+func BlobsSize(count int, size int64) {
+	blobsCount.Set(float64(count))
+	blobsBytes.Set(float64(size))
+}
+
+// Warmup increments the warm-up requests counter, labeled by the result
+func Warmup(ok bool) {
+	if ok {
+		warmupOK.Inc()
+	} else {
+		warmupFailed.Inc()
+	}
+}
+
+// WarmupFinished sets the time and duration of the last warm-up run
+func WarmupFinished(duration time.Duration) {
+	warmupLastRun.Set(float64(time.Now().Unix()))
+	warmupDuration.Set(duration.Seconds())
+}
+
+// UpstreamHealth sets the health of the upstream pool member, 1 for available and 0 for unhealthy or ejected
+func UpstreamHealth(upstream, member string, available bool) {
+	var value float64
+	if available {
+		value = 1
+	}
+	metrics.GetOrCreateGauge(fmt.Sprintf("drp_upstream_available{upstream=%q,member=%q}", upstream, member), nil).Set(value)
+}
+
+// Failover increments the counter of requests failed over to another upstream pool member
+func Failover() {
+	failovers.Inc()
+}
+
+// UpstreamRateLimit sets the pull rate limit of the upstream (Docker Hub) and the remaining amount of pulls
+func UpstreamRateLimit(upstream string, limit, remaining int) {
+	metrics.GetOrCreateGauge(fmt.Sprintf("drp_upstream_ratelimit_limit{upstream=%q}", upstream), nil).Set(float64(limit))
+	metrics.GetOrCreateGauge(fmt.Sprintf("drp_upstream_ratelimit_remaining{upstream=%q}", upstream), nil).Set(float64(remaining))
+}
+
+// UpstreamRetry increments the counter of retried upstream requests, or the counter of retries rejected by the budget
+func UpstreamRetry(upstream string, retried bool) {
+	if retried {
+		metrics.GetOrCreateCounter(fmt.Sprintf("drp_upstream_retries{upstream=%q}", upstream)).Inc()
+	} else {
+		metrics.GetOrCreateCounter(fmt.Sprintf("drp_upstream_retries_rejected{upstream=%q}", upstream)).Inc()
+	}
+}
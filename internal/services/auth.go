@@ -30,21 +30,55 @@ type Auth struct {
 	trustedIPs      map[string]bool
 	cacheAllowedOK  *expirable.LRU[string, bool]
 	cacheAllowedNOK *expirable.LRU[string, bool]
+	cacheTTL        time.Duration
+	cacheSize       int
 	provider        *AuthProvider
+	upstreams       map[string]*Auth // per-upstream overrides
 }
 
 // NewAuth creates a new Auth service
 func NewAuth(allowedIPs, allowedUAs, trustedIPs []string, cacheTTL, cacheSize int, provider *AuthProvider) *Auth {
+	ttl := time.Duration(cacheTTL) * time.Minute
 	return &Auth{
 		provider:        provider,
 		allowedIPs:      utils.NewMap(allowedIPs, true),
 		allowedUAs:      utils.NewMap(allowedUAs, true),
 		trustedIPs:      utils.NewMap(trustedIPs, true),
-		cacheAllowedOK:  expirable.NewLRU[string, bool](cacheSize, nil, time.Duration(cacheTTL)*time.Minute),
-		cacheAllowedNOK: expirable.NewLRU[string, bool](cacheSize, nil, time.Duration(cacheTTL)*time.Minute),
+		cacheAllowedOK:  expirable.NewLRU[string, bool](cacheSize, nil, ttl),
+		cacheAllowedNOK: expirable.NewLRU[string, bool](cacheSize, nil, ttl),
+		cacheTTL:        ttl,
+		cacheSize:       cacheSize,
+		upstreams:       map[string]*Auth{},
 	}
 }
 
+// AddUpstream overrides the lists for requests routed to the upstream, empty lists are inherited.
+// The override has its own cache of allowed IPs, and shares the auth provider
+func (a *Auth) AddUpstream(name string, allowedIPs, allowedUAs, trustedIPs []string) {
+	if len(allowedIPs) == 0 && len(allowedUAs) == 0 && len(trustedIPs) == 0 {
+		return
+	}
+
+	override := &Auth{
+		provider:        a.provider,
+		allowedIPs:      a.allowedIPs,
+		allowedUAs:      a.allowedUAs,
+		trustedIPs:      a.trustedIPs,
+		cacheAllowedOK:  expirable.NewLRU[string, bool](a.cacheSize, nil, a.cacheTTL),
+		cacheAllowedNOK: expirable.NewLRU[string, bool](a.cacheSize, nil, a.cacheTTL),
+	}
+	if len(allowedIPs) > 0 {
+		override.allowedIPs = utils.NewMap(allowedIPs, true)
+	}
+	if len(allowedUAs) > 0 {
+		override.allowedUAs = utils.NewMap(allowedUAs, true)
+	}
+	if len(trustedIPs) > 0 {
+		override.trustedIPs = utils.NewMap(trustedIPs, true)
+	}
+	a.upstreams[name] = override
+}
+
 // Middleware returns a middleware for echo
 func (a *Auth) Middleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -56,11 +90,15 @@ func (a *Auth) Middleware() echo.MiddlewareFunc {
 				return c.JSON(http.StatusInternalServerError, errors.NewResponse(http.StatusInternalServerError))
 			}
 
+			auth := a
+			if upstream := UpstreamOf(c); upstream != nil && a.upstreams[upstream.Name] != nil {
+				auth = a.upstreams[upstream.Name]
+			}
 			if allowedMethods[c.Request().Method] {
-				return a.middlewareAllowed(c, ip, log, next)
+				return auth.middlewareAllowed(c, ip, log, next)
 			}
 			if trustedMethods[c.Request().Method] {
-				return a.middlewareTrusted(c, ip, log, next)
+				return auth.middlewareTrusted(c, ip, log, next)
 			}
 			log.Info().Str("reason", "method not allowed").Msg("rejected")
 			return c.JSON(http.StatusMethodNotAllowed, errors.NewResponse(http.StatusMethodNotAllowed, fmt.Sprintf("Method %s is not allowed for IP %s", c.Request().Method, ip)))
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+var (
+	// blobEndpoint matches blob requests and captures the sha256 digest hex
+	blobEndpoint = regexp.MustCompile(`^/v2/.+/blobs/sha256:([a-f0-9]{64})$`)
+	// blobDigest matches the blob file names, the sha256 digest hex
+	blobDigest = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// Blobs is a middleware that caches blobs on the local disk, keyed by digest.
+// Blobs are content-addressed, so a single copy is shared across all repositories.
+// For backends with per-user permissions, access to the cached blobs is authorized with the backend.
+type Blobs struct {
+	enabled   bool
+	authorize bool
+	path      string
+	budget    int64
+	mu        sync.Mutex
+	size      int64
+	lru       *list.List
+	index     map[string]*list.Element
+}
+
+type blobEntry struct {
+	digest string
+	size   int64
+}
+
+// NewBlobs returns a new Blobs instance, path is the storage directory and size is the disk budget in megabytes.
+// If authorize is true, each cache hit is authorized with a HEAD request to the backend, using the client credentials.
+// Existing blobs found in the path are loaded into the index, the most recently modified ones being the hottest.
+func NewBlobs(path string, size int, authorize bool, log *zerolog.Logger) *Blobs {
+	blobs := &Blobs{
+		enabled:   path != "",
+		authorize: authorize,
+		path:      path,
+		budget:    int64(size) * 1024 * 1024,
+		lru:       list.New(),
+		index:     map[string]*list.Element{},
+	}
+	if !blobs.enabled {
+		return blobs
+	}
+
+	if err := blobs.load(); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("cannot load blobs cache, disabling it")
+		blobs.enabled = false
+		return blobs
+	}
+	log.Info().Str("path", path).Int("blobs", blobs.lru.Len()).Int64("size", blobs.size).Msg("blobs cache loaded")
+	return blobs
+}
+
+// Middleware returns a new echo.MiddlewareFunc that serves blobs from the local disk and stores blobs fetched from the backend
+func (b *Blobs) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !b.enabled {
+				return next(c)
+			}
+			method := c.Request().Method
+			if method != http.MethodGet && method != http.MethodHead {
+				return next(c)
+			}
+			match := blobEndpoint.FindStringSubmatch(c.Request().URL.Path)
+			if match == nil {
+				return next(c)
+			}
+
+			digest := match[1]
+			log := utils.NewLog(c)
+			if b.cached(digest) && b.authorized(c, next, log) && b.serve(c, digest) {
+				log.Info().Msg("blob cache hit")
+				go metrics.Blobs(true)
+				return nil
+			}
+
+			// HEAD requests have no body, and partial responses can't be verified, so they just pass through
+			if method == http.MethodHead || c.Request().Header.Get("Range") != "" {
+				return next(c)
+			}
+
+			go metrics.Blobs(false)
+			return b.record(c, digest, log, next)
+		}
+	}
+}
+
+// serve writes the blob from the local disk, if present. Range requests are handled by http.ServeContent
+func (b *Blobs) serve(c echo.Context, digest string) bool {
+	if !b.touch(digest) {
+		return false
+	}
+	f, err := os.Open(b.blobPath(digest))
+	if err != nil {
+		b.remove(digest)
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		b.remove(digest)
+		return false
+	}
+
+	headers := c.Response().Header()
+	headers.Set("Content-Type", "application/octet-stream")
+	headers.Set("Docker-Content-Digest", "sha256:"+digest)
+	headers.Set("Etag", `"sha256:`+digest+`"`)
+	headers.Set("X-Cache", "HIT")
+	http.ServeContent(c.Response(), c.Request(), "", info.ModTime(), f)
+	return true
+}
+
+// authorized checks that the backend allows the client to access the blob, if the authorization is enabled
+func (b *Blobs) authorized(c echo.Context, next echo.HandlerFunc, log *zerolog.Logger) bool {
+	if !b.authorize {
+		return true
+	}
+	hc := internalContext(c, http.MethodHead)
+	hc.Set("mode.exempt", true) // the authorization of a cache hit
+	if err := next(hc); err != nil {
+		log.Warn().Err(err).Msg("blob authorization failed")
+		return false
+	}
+	if status := responseStatus(hc); status != http.StatusOK {
+		log.Info().Int("status", status).Msg("blob access denied by the backend")
+		return false
+	}
+	return true
+}
+
+// record tees the backend response into a temporary file, and commits it to the storage only if the digest matches
+func (b *Blobs) record(c echo.Context, digest string, log *zerolog.Logger, next echo.HandlerFunc) error {
+	tmp, err := os.CreateTemp(filepath.Join(b.path, "tmp"), digest+"-*")
+	if err != nil {
+		log.Warn().Err(err).Msg("cannot create temporary blob file")
+		return next(c)
+	}
+	defer os.Remove(tmp.Name())
+
+	rec := &blobRecorder{ResponseWriter: c.Response().Writer, file: tmp, hash: sha256.New()}
+	c.Response().Writer = rec
+	c.Response().Header().Set("X-Cache", "MISS")
+	err = next(c)
+	if cerr := tmp.Close(); cerr != nil {
+		rec.failed = true
+	}
+	if err != nil || rec.failed || responseStatus(c) != http.StatusOK {
+		return err
+	}
+	if actual := hex.EncodeToString(rec.hash.Sum(nil)); actual != digest {
+		log.Warn().Str("actual", actual).Msg("blob digest mismatch, not caching")
+		return nil
+	}
+	if rec.size > b.budget {
+		log.Debug().Int64("size", rec.size).Msg("blob is larger than the cache budget, not caching")
+		return nil
+	}
+
+	target := b.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		log.Warn().Err(err).Msg("cannot create blob directory")
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		log.Warn().Err(err).Msg("cannot store blob")
+		return nil
+	}
+	b.add(digest, rec.size)
+	log.Debug().Int64("size", rec.size).Msg("blob stored")
+	return nil
+}
+
+// load prepares the storage directory and loads existing blobs into the index
+func (b *Blobs) load() error {
+	if err := os.RemoveAll(filepath.Join(b.path, "tmp")); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(b.path, "tmp"), 0o700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(b.path, "sha256"), 0o700); err != nil {
+		return err
+	}
+
+	type found struct {
+		entry *blobEntry
+		mtime int64
+	}
+	entries := []found{}
+	err := filepath.WalkDir(filepath.Join(b.path, "sha256"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// stray files (e.g. editor or OS leftovers) are not blobs
+		if !blobDigest.MatchString(d.Name()) || path != b.blobPath(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, found{&blobEntry{digest: d.Name(), size: info.Size()}, info.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime < entries[j].mtime })
+	for _, e := range entries {
+		b.add(e.entry.digest, e.entry.size)
+	}
+	return nil
+}
+
+// add puts the blob to the front of the index and evicts the least recently used blobs above the budget
+func (b *Blobs) add(digest string, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.index[digest]; ok {
+		b.size -= el.Value.(*blobEntry).size //nolint:forcetypeassert // list contains only *blobEntry
+		b.lru.Remove(el)
+	}
+	b.index[digest] = b.lru.PushFront(&blobEntry{digest: digest, size: size})
+	b.size += size
+
+	for b.size > b.budget {
+		oldest := b.lru.Back()
+		if oldest == nil {
+			break
+		}
+		b.evict(oldest)
+	}
+	go metrics.BlobsSize(b.lru.Len(), b.size)
+}
+
+// cached checks if the blob is cached, without marking it as recently used
+func (b *Blobs) cached(digest string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.index[digest]
+	return ok
+}
+
+// touch marks the blob as recently used, returns false if the blob is not cached
+func (b *Blobs) touch(digest string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	el, ok := b.index[digest]
+	if ok {
+		b.lru.MoveToFront(el)
+	}
+	return ok
+}
+
+// remove drops the blob from the index and the disk
+func (b *Blobs) remove(digest string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.index[digest]; ok {
+		b.evict(el)
+	}
+}
+
+// evict removes the blob from the index and the disk, must be called with the lock held
+func (b *Blobs) evict(el *list.Element) {
+	entry := el.Value.(*blobEntry) //nolint:forcetypeassert // list contains only *blobEntry
+	b.lru.Remove(el)
+	delete(b.index, entry.digest)
+	b.size -= entry.size
+	os.Remove(b.blobPath(entry.digest))
+}
+
+// blobPath returns the storage path of the blob, e.g. /path/sha256/ab/abcdef...
+func (b *Blobs) blobPath(digest string) string {
+	return filepath.Join(b.path, "sha256", digest[:2], digest)
+}
+
+// blobRecorder writes the response both to the client and to the temporary file.
+// Disk failures never interrupt the client response, the blob just won't be cached
+type blobRecorder struct {
+	http.ResponseWriter
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	failed bool
+}
+
+func (r *blobRecorder) Write(b []byte) (int, error) {
+	i, err := r.ResponseWriter.Write(b)
+	if err != nil {
+		r.failed = true
+		return i, err
+	}
+	if !r.failed {
+		if _, ferr := r.file.Write(b[:i]); ferr != nil {
+			r.failed = true
+		}
+		r.hash.Write(b[:i])
+		r.size += int64(i)
+	}
+	return i, nil
+}
+
+// Unwrap returns the original writer, used by http.ResponseController to flush the response
+func (r *blobRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBlobsLoadSkipsStrayFiles(t *testing.T) {
+	log := zerolog.Nop()
+	dir := t.TempDir()
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("blob")))
+	files := map[string]string{
+		filepath.Join("sha256", digest[:2], digest): "blob",
+		filepath.Join("sha256", ".DS_Store"):        "stray",
+		filepath.Join("sha256", digest[:2], "x"):    "stray",
+		filepath.Join("sha256", "00", digest):       "misplaced",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobs := NewBlobs(dir, 1, false, &log)
+	if !blobs.enabled {
+		t.Fatal("blobs cache is disabled")
+	}
+	if blobs.lru.Len() != 1 || !blobs.cached(digest) {
+		t.Errorf("%d blobs loaded, expected the valid one only", blobs.lru.Len())
+	}
+}
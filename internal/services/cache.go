@@ -2,19 +2,25 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
 	"net/textproto"
+	"net/url"
 	"regexp"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/etkecc/go-apm"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
 
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/errors"
 	"github.com/etkecc/docker-registry-proxy/internal/metrics"
 	"github.com/etkecc/docker-registry-proxy/internal/utils"
 )
@@ -22,70 +28,181 @@ import (
 var (
 	// acceptHeader is the canonicalized "Accept" header key.
 	acceptHeader = textproto.CanonicalMIMEHeaderKey("Accept")
-	// cacheableStatuses is a map of HTTP status codes that are cacheable.
-	cacheableStatuses = map[int]bool{
-		http.StatusOK:        true,
-		http.StatusNoContent: true,
-	}
-	// cacheableEndpoints is a list of regular expressions that match cacheable endpoints.
-	cacheableEndpoints = []*regexp.Regexp{
-		regexp.MustCompile(`^GET /v2/$`),
-		regexp.MustCompile(`^HEAD /v2/$`),
-
-		regexp.MustCompile(`^GET /v2/_catalog$`),
-		regexp.MustCompile(`^GET /v2/_catalog\?n=\d*$`),
-
-		regexp.MustCompile(`^GET /v2/.*/tags/list$`),
-		regexp.MustCompile(`^GET /v2/.*/tags/list\?n=\d*$`),
-
-		regexp.MustCompile(`^HEAD /v2/.*/manifests/.*$`),
-	}
+	// mutationEndpoint matches requests that change the repository content, and captures the repository name
+	mutationEndpoint = regexp.MustCompile(`^(?:PUT|DELETE) /v2/(.+)/(?:manifests|blobs)/[^/]+$`)
+	// repositoryEndpoint captures the repository name from the request path
+	repositoryEndpoint = regexp.MustCompile(`^/v2/(.+)/(?:manifests|blobs|tags)/`)
+	// referenceEndpoint captures the manifest reference (tag or digest) from the request path
+	referenceEndpoint = regexp.MustCompile(`^/v2/.+/manifests/([^/]+)$`)
+	// linkURL matches URLs in the Link header, e.g. </v2/_catalog?last=a&n=1>; rel="next"
+	linkURL = regexp.MustCompile(`<[^>]*>`)
 )
 
-// Cache is a middleware that caches responses according to the Docker Registry API v2 specification, cacheable endpoints and status codes.
+// Cache is a middleware that caches responses according to the cache rules (Docker Registry API v2 specification by default).
+// Immutable responses (manifests fetched by digest) are stored in a separate backend with its own TTL and size.
+// Manifests fetched by tag are revalidated with the backend after the freshness period.
+// Concurrent identical requests are coalesced, so only one of them goes to the backend on cache miss.
+// Successful pushes and deletions evict all cached entries of the repository and the catalog.
+// The cache may be partitioned by client credentials, for backends with per-user permissions.
+// Expired entries are kept for the grace period and served when the backend fails (stale-if-error),
+// or right away while being refreshed in the background (stale-while-revalidate).
+// The stores are either local, or shared by all proxy instances (with fallback to the local ones).
 type Cache struct {
-	enabled bool
-	backend *expirable.LRU[string, cached]
+	enabled         bool
+	freshness       time.Duration
+	ttl             time.Duration
+	immutableTTL    time.Duration
+	staleRevalidate time.Duration
+	entryMax        int
+	rules           []*cacheRule
+	compressor      *compressor
+	backend         cacheStore
+	immutable       cacheStore
+	mu              sync.Mutex
+	inflight        map[string]*flight
 }
 
 // NewCache returns a new Cache instance.
-func NewCache(enabled bool, ttl, size int) *Cache {
-	return &Cache{
-		enabled: enabled,
-		backend: expirable.NewLRU[string, cached](size, nil, time.Duration(ttl)*time.Minute),
+func NewCache(cfg *config.Cache, log *zerolog.Logger) *Cache {
+	rules, err := newCacheRules(cfg.Rules, cfg.RulesNoDefault)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid cache rules, using the default rules")
+		rules, _ = newCacheRules(nil, false) //nolint:errcheck // default rules are valid
+	}
+	compressor, err := newCompressor(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid cache compression, cached bodies won't be compressed")
+	}
+	public := utils.NewMap(cfg.Public, true)
+	for _, rule := range rules {
+		rule.partition = cfg.Partition && !public[rule.name]
+	}
+	cache := &Cache{
+		rules:           rules,
+		compressor:      compressor,
+		enabled:         !cfg.Disabled,
+		freshness:       time.Duration(cfg.TagsFreshness) * time.Second,
+		ttl:             time.Duration(cfg.TTL) * time.Minute,
+		immutableTTL:    time.Duration(cfg.ImmutableTTL) * time.Minute,
+		staleRevalidate: time.Duration(cfg.StaleRevalidate) * time.Second,
+		entryMax:        cfg.EntryMax * 1024,
+		inflight:        map[string]*flight{},
+	}
+	grace := time.Duration(cfg.Stale) * time.Minute
+	backend := newMemoryStore(int64(cfg.Budget)*1024*1024, cache.ttl, grace)
+	immutable := newMemoryStore(int64(cfg.ImmutableBudget)*1024*1024, cache.immutableTTL, grace)
+	cache.backend, cache.immutable = backend, immutable
+	if cfg.Shared != "" {
+		client, err := newRedisClient(cfg.Shared)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid shared cache URL, using local cache only")
+		} else {
+			cache.backend = newSharedStore(newRedisStore(client, cfg.SharedNamespace, "main", cache.ttl, grace), backend, log)
+			cache.immutable = newSharedStore(newRedisStore(client, cfg.SharedNamespace, "immutable", cache.immutableTTL, grace), immutable, log)
+		}
 	}
+	metrics.CacheStats("main", cache.backend.Stats)
+	metrics.CacheStats("immutable", cache.immutable.Stats)
+	return cache
 }
 
 // Middleware returns a new echo.MiddlewareFunc that caches responses according to the Docker Registry API v2 specification, cacheable endpoints and status codes.
 func (cache *Cache) Middleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			if !cache.enabled {
+			upstream := UpstreamOf(c)
+			if !cache.enabled || (upstream != nil && upstream.cacheDisabled) {
 				return next(c)
 			}
 
 			go metrics.Request(c.Request().Method, c.Request().URL.Path)
-			cachekey := cache.key(c)
-			cacheable := isCacheable(c)
 			log := utils.NewLog(c)
 
-			if !cacheable {
+			if repo, ok := mutatedRepository(c); ok {
+				err := next(c)
+				if status := responseStatus(c); status >= 200 && status < 300 {
+					cache.invalidate(repo, log)
+				}
+				return err
+			}
+
+			rule := matchCacheRule(cache.rules, c.Request())
+			if rule == nil {
 				log.Debug().Msg("not cacheable")
 				return next(c)
 			}
 
-			if cache.returnCached(c, cachekey) {
+			cachekey := rule.key(c.Request(), upstream)
+			backend := cache.backend
+			var digest string
+			if rule.immutable {
+				backend = cache.immutable
+				digest = reference(c.Request().URL.Path)
+			}
+
+			fresh := !rule.revalidate || cache.revalidate(c, next, rule, cachekey, log)
+			if !fresh {
+				// Get is skipped, but the access must be counted, otherwise the entry is never admitted to the full store
+				backend.Touch(cachekey)
+			}
+			if fresh && cache.returnCached(c, backend, cachekey) {
 				log.Info().Msg("cache hit")
 				go metrics.Cache(true)
 				return nil
 			}
 
+			stale, expiredFor, hasStale := backend.Stale(cachekey)
+			if hasStale && expiredFor > 0 && expiredFor < cache.staleRevalidate {
+				log.Info().Msg("cache stale, refreshing in background")
+				go metrics.Stale(false)
+				writeStale(c, &stale, `110 - "Response is Stale"`)
+				go cache.refresh(internalContext(c, c.Request().Method), next, rule, backend, cachekey, digest)
+				return nil
+			}
+
+			var servedStale bool
+			if hasStale {
+				// called by the proxy when the backend fails
+				c.Set("proxy.fallback", func() {
+					writeStale(c, &stale, `111 - "Revalidation Failed"`)
+					servedStale = true
+				})
+			}
+
+			f, leader := cache.join(cachekey)
+			if !leader {
+				if cache.wait(c, f) {
+					log.Info().Msg("cache coalesced")
+					go metrics.Coalesced()
+					return nil
+				}
+				return next(c)
+			}
+			defer cache.leave(cachekey, f)
+
 			rec, err := cache.record(c, next)
 			if err != nil {
 				return err
 			}
 
-			if cache.store(c, rec, cachekey) {
+			if servedStale {
+				log.Warn().Msg("backend failed, served stale")
+				go metrics.Stale(true)
+				return nil
+			}
+
+			if rec.overflow {
+				log.Debug().Int("max", cache.entryMax).Msg("response is too large, not caching")
+				go metrics.CacheRejected()
+				return nil
+			}
+
+			if digest != "" && !verifyDigest(decodedBody(c.Response().Header(), rec.body.Bytes()), digest) {
+				log.Warn().Str("digest", digest).Msg("manifest digest mismatch, not caching")
+				return nil
+			}
+
+			if f.result = cache.store(c, rule, backend, rec, cachekey); f.result != nil {
 				log.Debug().Msg("cache miss")
 				go metrics.Cache(false)
 				return nil
@@ -96,62 +213,219 @@ func (cache *Cache) Middleware() echo.MiddlewareFunc {
 	}
 }
 
-func (cache *Cache) returnCached(c echo.Context, cachekey string) bool {
-	if v, ok := cache.backend.Get(cachekey); ok {
-		resp := v.Response() //nolint:bodyclose // it's io.NopCloser
-		resp.Header.Set("X-Cache", "HIT")
-		for k := range resp.Header {
-			c.Response().Header().Set(k, resp.Header.Get(k))
-		}
-		c.Response().WriteHeader(resp.StatusCode)
-		c.Response().Write(v.Body) //nolint:errcheck // ignore error
+func (cache *Cache) returnCached(c echo.Context, backend cacheStore, cachekey string) bool {
+	if v, ok := backend.Get(cachekey); ok {
+		writeCached(c, &v, "HIT")
 		return true
 	}
 	return false
 }
 
+// join registers the request as in-flight, returns the existing flight and false if there is one already
+func (cache *Cache) join(cachekey string) (*flight, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if f, ok := cache.inflight[cachekey]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	cache.inflight[cachekey] = f
+	return f, true
+}
+
+// leave unregisters the in-flight request and wakes up the waiting requests
+func (cache *Cache) leave(cachekey string, f *flight) {
+	cache.mu.Lock()
+	delete(cache.inflight, cachekey)
+	cache.mu.Unlock()
+	close(f.done)
+}
+
+// wait waits for the in-flight request and writes its response, returns false if the response wasn't cacheable
+func (cache *Cache) wait(c echo.Context, f *flight) bool {
+	select {
+	case <-f.done:
+	case <-c.Request().Context().Done():
+		return false
+	}
+	if f.result == nil {
+		return false
+	}
+	writeCached(c, f.result, "COALESCED")
+	return true
+}
+
+// revalidate checks if the cached tag manifest is still fresh, otherwise sends a HEAD request to the backend
+// and compares the digests. Fresh and unchanged entries are kept, changed entries are removed from the cache
+func (cache *Cache) revalidate(c echo.Context, next echo.HandlerFunc, rule *cacheRule, cachekey string, log *zerolog.Logger) bool {
+	v, ok := cache.backend.Peek(cachekey)
+	if !ok {
+		return false
+	}
+	if time.Since(v.Stored) < cache.freshness {
+		return true
+	}
+
+	// concurrent revalidations of the entry are coalesced, so the backend gets a single HEAD request
+	flightkey := "revalidate:" + cachekey
+	f, leader := cache.join(flightkey)
+	if !leader {
+		select {
+		case <-f.done:
+		case <-c.Request().Context().Done():
+			return false
+		}
+		return f.result != nil
+	}
+	defer cache.leave(flightkey, f)
+
+	hc := internalContext(c, http.MethodHead)
+	hc.Set("mode.exempt", true) // the revalidation of a cache hit
+	if err := next(hc); err != nil {
+		log.Warn().Err(err).Msg("revalidation failed")
+		return false
+	}
+	// backend failure doesn't mean the tag has changed, the cached entry is kept to be served as stale
+	if status := responseStatus(hc); status >= http.StatusInternalServerError {
+		log.Warn().Int("status", status).Msg("revalidation failed")
+		return false
+	}
+
+	current := cachedDigest(hc.Response().Header())
+	if responseStatus(hc) != http.StatusOK || current == "" || current != cachedDigest(v.Header) {
+		log.Debug().Str("digest", current).Msg("revalidation: changed")
+		go metrics.Revalidation(true)
+		cache.backend.Remove(cachekey)
+		return false
+	}
+
+	log.Debug().Str("digest", current).Msg("revalidation: unchanged")
+	go metrics.Revalidation(false)
+	v.Stored = time.Now()
+	v.Expires = v.Stored.Add(cache.ttlOf(c, rule, cache.backend))
+	if cache.backend.Add(cachekey, v) {
+		f.result = &v
+	}
+	return true
+}
+
+// refresh fetches the response with the internal context and stores it, used to refresh stale entries in the background
+func (cache *Cache) refresh(hc echo.Context, next echo.HandlerFunc, rule *cacheRule, backend cacheStore, cachekey, digest string) {
+	f, leader := cache.join(cachekey)
+	if !leader {
+		return
+	}
+	defer cache.leave(cachekey, f)
+
+	log := utils.NewLog(hc)
+	rec, err := cache.record(hc, next)
+	if err != nil || rec.overflow {
+		log.Warn().Err(err).Msg("background refresh failed")
+		return
+	}
+	if digest != "" && !verifyDigest(decodedBody(hc.Response().Header(), rec.body.Bytes()), digest) {
+		log.Warn().Str("digest", digest).Msg("manifest digest mismatch, not caching")
+		return
+	}
+	if f.result = cache.store(hc, rule, backend, rec, cachekey); f.result != nil {
+		log.Debug().Msg("refreshed in background")
+	}
+}
+
+// internalContext creates a new echo context for internal requests to the backend, based on the client request.
+// It's detached from the client request, and its response is discarded (except headers)
+func internalContext(c echo.Context, method string) echo.Context {
+	req := c.Request().Clone(apm.NewContext(context.WithoutCancel(c.Request().Context())))
+	req.Method = method
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	// the full (and decoded) response is needed for the cache, not the client's 304
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	req.Header.Del("Accept-Encoding")
+	hc := c.Echo().NewContext(req, &discardWriter{header: http.Header{}})
+	hc.Set("upstream", c.Get("upstream"))
+	hc.Set("public", c.Get("public"))
+	return hc
+}
+
 func (cache *Cache) record(c echo.Context, next echo.HandlerFunc) (*recorder, error) {
-	rec := &recorder{c.Response().Writer, bytes.Buffer{}}
+	rec := &recorder{ResponseWriter: c.Response().Writer, limit: cache.entryMax}
 	c.Response().Writer = rec
 	c.Response().Header().Set("X-Cache", "MISS")
 	err := next(c)
 	return rec, err
 }
 
-func (cache *Cache) store(c echo.Context, rec *recorder, cachekey string) bool {
-	var status int
-	if s, ok := c.Get("resp.status").(int); ok {
-		status = s
-	} else {
-		status = c.Response().Status
-	}
-	if !cacheableStatuses[status] {
-		return false
+func (cache *Cache) store(c echo.Context, rule *cacheRule, backend cacheStore, rec *recorder, cachekey string) *cached {
+	if rec.overflow || !rule.statuses[responseStatus(c)] {
+		return nil
 	}
 
 	headers := c.Response().Header().Clone()
 	headers.Del("Date")
+	if link := headers.Get("Link"); link != "" {
+		// the Link header points at the public endpoint of the request, and the cached response is served to any endpoint
+		headers.Set("Link", relativeLink(link, PublicOf(c)))
+	}
+	now := time.Now()
+	if etag := entityTag(headers, decodedBody(headers, rec.body.Bytes()), c.Request().Method == http.MethodHead); etag != "" {
+		headers.Set("Etag", etag)
+	}
+	if headers.Get("Last-Modified") == "" {
+		headers.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+	}
 	resp := cached{
 		ContentLength: int64(rec.body.Len()),
 		StatusCode:    c.Response().Status,
 		Header:        headers,
 		Body:          rec.body.Bytes(),
+		Stored:        now,
+		Expires:       now.Add(cache.ttlOf(c, rule, backend)),
+		Method:        c.Request().Method,
+		URL:           c.Request().URL.String(),
+		Repository:    repository(c.Request().URL.Path),
+		Reference:     reference(c.Request().URL.Path),
 	}
-	cache.backend.Add(cachekey, resp)
-	return true
+	adoptEncoding(&resp)
+	cache.compressor.compress(&resp)
+	if !backend.Add(cachekey, resp) {
+		go metrics.CacheRejected()
+		return nil
+	}
+	return &resp
 }
 
-func (cache *Cache) key(c echo.Context) string {
-	hasher := sha256.New()
-	hasher.Write([]byte(c.Request().Method))
-	hasher.Write([]byte(c.Request().URL.String()))
-	acceptValues := c.Request().Header[acceptHeader]
-	if len(acceptValues) > 0 {
-		sort.Strings(acceptValues)
-		hasher.Write([]byte(strings.Join(acceptValues, ",")))
+// invalidate evicts all cached entries of the repository and the catalog
+func (cache *Cache) invalidate(repo string, log *zerolog.Logger) {
+	var evicted int
+	for _, backend := range []cacheStore{cache.backend, cache.immutable} {
+		for _, r := range []string{repo, ""} {
+			for _, cachekey := range backend.Index(r) {
+				if backend.Remove(cachekey) {
+					evicted++
+				}
+			}
+		}
 	}
+	log.Info().Str("repository", repo).Int("evicted", evicted).Msg("cache invalidated")
+	go metrics.Invalidated(evicted)
+}
 
-	return fmt.Sprintf("%x", hasher.Sum(nil))
+// ttlOf returns the TTL of the rule, or the TTL of the store if the rule doesn't have one.
+// The upstream TTL overrides the TTL of the main store
+func (cache *Cache) ttlOf(c echo.Context, rule *cacheRule, backend cacheStore) time.Duration {
+	if rule.ttl > 0 {
+		return rule.ttl
+	}
+	if backend == cache.immutable {
+		return cache.immutableTTL
+	}
+	if upstream := UpstreamOf(c); upstream != nil && upstream.cacheTTL > 0 {
+		return upstream.cacheTTL
+	}
+	return cache.ttl
 }
 
 type cached struct {
@@ -159,6 +433,25 @@ type cached struct {
 	StatusCode    int
 	Header        http.Header
 	Body          []byte
+	Encoding      string // content coding of the body (gzip, deflate), empty for the raw body
+	Stored        time.Time
+	Expires       time.Time
+	Method        string
+	URL           string
+	Repository    string
+	Reference     string
+}
+
+// size returns the approximate memory footprint of the cached response
+func (c *cached) size() int64 {
+	size := int64(len(c.Body) + len(c.URL) + len(c.Repository) + len(c.Reference))
+	for k, values := range c.Header {
+		size += int64(len(k))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
 }
 
 func (c *cached) Response() *http.Response {
@@ -173,9 +466,19 @@ func (c *cached) Response() *http.Response {
 	}
 }
 
+// flight is an in-flight request or revalidation, result is set only if the response was cached (or is still valid)
+type flight struct {
+	done   chan struct{}
+	result *cached
+}
+
+// recorder writes the response to the client and buffers it for the cache, up to the limit.
+// Once the limit is exceeded, the buffer is dropped, but the response is still streamed to the client
 type recorder struct {
 	http.ResponseWriter
-	body bytes.Buffer
+	body     bytes.Buffer
+	limit    int
+	overflow bool
 }
 
 func (r *recorder) Write(b []byte) (int, error) {
@@ -183,15 +486,212 @@ func (r *recorder) Write(b []byte) (int, error) {
 	if err != nil {
 		return i, err
 	}
+	if r.overflow {
+		return i, nil
+	}
+	if r.limit > 0 && r.body.Len()+i > r.limit {
+		r.overflow = true
+		r.body = bytes.Buffer{}
+		return i, nil
+	}
 	return r.body.Write(b[:i])
 }
 
-func isCacheable(c echo.Context) bool {
-	endpoint := c.Request().Method + " " + c.Request().URL.String()
-	for _, re := range cacheableEndpoints {
-		if re.MatchString(endpoint) {
+// Unwrap returns the original writer, used by http.ResponseController to flush the response
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// discardWriter is a response writer for internal requests, it keeps the headers and discards everything else
+type discardWriter struct {
+	header http.Header
+}
+
+func (r *discardWriter) Header() http.Header {
+	return r.header
+}
+
+func (r *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (r *discardWriter) WriteHeader(int) {}
+
+func (r *discardWriter) Flush() {}
+
+// bufferWriter is a response writer for internal requests, it keeps the headers and, optionally, the body
+type bufferWriter struct {
+	discardWriter
+	keep bool
+	body bytes.Buffer
+}
+
+func (w *bufferWriter) Write(b []byte) (int, error) {
+	if !w.keep {
+		return len(b), nil
+	}
+	return w.body.Write(b)
+}
+
+// responseStatus returns the backend response status, if available, or the echo response status otherwise
+func responseStatus(c echo.Context) int {
+	if s, ok := c.Get("resp.status").(int); ok {
+		return s
+	}
+	return c.Response().Status
+}
+
+// verifyDigest checks that the body hashes to the digest, e.g. sha256:abcdef...
+func verifyDigest(body []byte, digest string) bool {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)) == digest
+}
+
+// cachedDigest returns the content digest from the response headers, falling back to the ETag
+func cachedDigest(headers http.Header) string {
+	if digest := headers.Get("Docker-Content-Digest"); digest != "" {
+		return digest
+	}
+	return strings.Trim(headers.Get("Etag"), `"`)
+}
+
+// writeCached writes the cached response to the client, marking it with the X-Cache header.
+// Conditional requests matching the cached response get 304 Not Modified without body.
+// Compressed bodies are served as is to clients accepting the encoding, and decompressed for others
+func writeCached(c echo.Context, v *cached, xcache string) {
+	resp := v.Response() //nolint:bodyclose // it's io.NopCloser
+	resp.Header.Set("X-Cache", xcache)
+	for k := range resp.Header {
+		c.Response().Header().Set(k, resp.Header.Get(k))
+	}
+	if link := resp.Header.Get("Link"); link != "" {
+		c.Response().Header().Set("Link", absoluteLink(link, PublicOf(c)))
+	}
+	if notModified(c.Request(), v) {
+		c.Response().Header().Del("Content-Length")
+		c.Response().WriteHeader(http.StatusNotModified)
+		go metrics.NotModified()
+		return
+	}
+
+	body := v.Body
+	if v.Encoding != "" {
+		c.Response().Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(c.Request(), v.Encoding) {
+			c.Response().Header().Set("Content-Encoding", v.Encoding)
+		} else {
+			var err error
+			if body, err = decompress(v); err != nil {
+				utils.NewLog(c).Error().Err(err).Msg("cannot decompress cached body")
+				errors.NewResponse(http.StatusInternalServerError).WriteTo(c.Request().Context(), c.Response())
+				return
+			}
+		}
+		c.Response().Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	c.Response().WriteHeader(resp.StatusCode)
+	c.Response().Write(body) //nolint:errcheck // ignore error
+}
+
+// relativeLink strips the public endpoint from the Link header URLs, e.g. <https://public/v2/_catalog?n=1> -> </v2/_catalog?n=1>
+func relativeLink(link string, public *url.URL) string {
+	return linkURL.ReplaceAllStringFunc(link, func(match string) string {
+		target, err := url.Parse(strings.Trim(match, "<>"))
+		if err != nil || target.Host != public.Host {
+			return match
+		}
+		target.Scheme, target.Host = "", ""
+		return "<" + target.String() + ">"
+	})
+}
+
+// absoluteLink points the relative Link header URLs at the public endpoint, e.g. </v2/_catalog?n=1> -> <https://public/v2/_catalog?n=1>
+func absoluteLink(link string, public *url.URL) string {
+	return linkURL.ReplaceAllStringFunc(link, func(match string) string {
+		target, err := url.Parse(strings.Trim(match, "<>"))
+		if err != nil || target.Host != "" || !strings.HasPrefix(target.Path, "/") || public.Host == "" {
+			return match
+		}
+		target.Scheme, target.Host = public.Scheme, public.Host
+		return "<" + target.String() + ">"
+	})
+}
+
+// entityTag returns a stable ETag of the response: the content digest if present, the backend ETag otherwise,
+// or the body hash as the last resort (except HEAD responses, which have no body)
+func entityTag(headers http.Header, body []byte, head bool) string {
+	if digest := headers.Get("Docker-Content-Digest"); digest != "" {
+		return `"` + digest + `"`
+	}
+	if etag := headers.Get("Etag"); etag != "" || head {
+		return etag
+	}
+	return fmt.Sprintf(`"sha256:%x"`, sha256.Sum256(body))
+}
+
+// notModified evaluates the conditional request headers against the cached response,
+// If-None-Match takes precedence over If-Modified-Since, see RFC 9110, section 13.2.2
+func notModified(req *http.Request, v *cached) bool {
+	if v.StatusCode != http.StatusOK || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	if inm := req.Header.Values("If-None-Match"); len(inm) > 0 {
+		return etagMatch(strings.Join(inm, ","), v.Header.Get("Etag"))
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(v.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+// etagMatch checks if the If-None-Match list contains the etag, using the weak comparison
+func etagMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
 			return true
 		}
 	}
 	return false
 }
+
+// mutatedRepository returns the repository name if the request changes its content (push or deletion)
+func mutatedRepository(c echo.Context) (string, bool) {
+	match := mutationEndpoint.FindStringSubmatch(c.Request().Method + " " + c.Request().URL.Path)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// repository returns the repository name from the request path, or empty string for catalog and /v2/
+func repository(path string) string {
+	match := repositoryEndpoint.FindStringSubmatch(path)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// reference returns the manifest reference (tag or digest) from the request path, or empty string for any other request
+func reference(path string) string {
+	match := referenceEndpoint.FindStringSubmatch(path)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// writeStale writes the stale cached response to the client, with the Warning header
+func writeStale(c echo.Context, v *cached, warning string) {
+	c.Response().Header().Set("Warning", warning)
+	writeCached(c, v, "STALE")
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"path"
+	"sort"
+	"time"
+)
+
+// CacheEntry is a cached response description for the admin API
+type CacheEntry struct {
+	Method     string `json:"method"`
+	URL        string `json:"url"`
+	Repository string `json:"repository,omitempty"`
+	Reference  string `json:"reference,omitempty"`
+	Immutable  bool   `json:"immutable"`
+	Size       int64  `json:"size"` // stored body size in bytes (compressed, if the body is compressed)
+	Age        int64  `json:"age"`  // seconds since the response was stored
+	TTL        int64  `json:"ttl"`  // seconds until the entry expires
+}
+
+// CachePurge is a filter for the cache purge, all non-empty fields must match
+type CachePurge struct {
+	URL        string `query:"url"`        // exact URL, e.g. /v2/foo/bar/tags/list
+	Repository string `query:"repository"` // repository name, e.g. foo/bar
+	Tag        string `query:"tag"`        // manifest reference, e.g. latest
+	Pattern    string `query:"pattern"`    // glob pattern of the URL, see path.Match, e.g. /v2/foo/*/tags/list
+	All        bool   `query:"all"`        // purge everything
+}
+
+// IsEmpty checks if the filter has no conditions, to prevent accidental purge of everything
+func (p CachePurge) IsEmpty() bool {
+	return !p.All && p.URL == "" && p.Repository == "" && p.Tag == "" && p.Pattern == ""
+}
+
+// match checks if the cached entry matches the filter
+func (p CachePurge) match(v *cached) bool {
+	if p.All {
+		return true
+	}
+	if p.URL != "" && p.URL != v.URL {
+		return false
+	}
+	if p.Repository != "" && p.Repository != v.Repository {
+		return false
+	}
+	if p.Tag != "" && p.Tag != v.Reference {
+		return false
+	}
+	if p.Pattern != "" {
+		if ok, err := path.Match(p.Pattern, v.URL); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Entries returns all cached entries, sorted by URL
+func (cache *Cache) Entries() []CacheEntry {
+	now := time.Now()
+	entries := []CacheEntry{}
+	for _, backend := range []cacheStore{cache.backend, cache.immutable} {
+		for _, v := range backend.Values() {
+			entries = append(entries, CacheEntry{
+				Method:     v.Method,
+				URL:        v.URL,
+				Repository: v.Repository,
+				Reference:  v.Reference,
+				Immutable:  backend == cache.immutable,
+				Size:       int64(len(v.Body)),
+				Age:        int64(now.Sub(v.Stored).Seconds()),
+				TTL:        int64(v.Expires.Sub(now).Seconds()),
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL == entries[j].URL {
+			return entries[i].Method < entries[j].Method
+		}
+		return entries[i].URL < entries[j].URL
+	})
+	return entries
+}
+
+// Purge removes cached entries matching the filter, returns the number of removed entries.
+// Expired entries are purged as well, otherwise they'd be served as stale when the backend fails
+func (cache *Cache) Purge(filter CachePurge) int {
+	if filter.IsEmpty() {
+		return 0
+	}
+
+	var purged int
+	for _, backend := range []cacheStore{cache.backend, cache.immutable} {
+		var keys []string
+		if filter.Repository != "" && !filter.All {
+			// the repository index allows to avoid full scan
+			keys = backend.Index(filter.Repository)
+		} else {
+			keys = backend.Keys()
+		}
+		for _, cachekey := range keys {
+			if v, _, ok := backend.Stale(cachekey); ok && filter.match(&v) && backend.Remove(cachekey) {
+				purged++
+			}
+		}
+	}
+	return purged
+}
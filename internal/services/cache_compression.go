@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+)
+
+// compressedTypes are the content types that are already compressed, so they're stored as is
+var compressedTypes = map[string]bool{
+	"application/gzip":                                          true,
+	"application/x-gzip":                                        true,
+	"application/zip":                                           true,
+	"application/zstd":                                          true,
+	"application/x-xz":                                          true,
+	"application/x-bzip2":                                       true,
+	"application/vnd.oci.image.layer.v1.tar+gzip":               true,
+	"application/vnd.oci.image.layer.v1.tar+zstd":               true,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":         true,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": true,
+}
+
+// compressor compresses cached bodies with gzip or deflate (zlib format, as the "deflate" content coding in HTTP)
+type compressor struct {
+	encoding string
+	level    int
+}
+
+// newCompressor returns a new compressor for the algorithm (gzip, deflate), or nil if the algorithm is none or empty
+func newCompressor(algorithm string, level int) (*compressor, error) {
+	switch algorithm {
+	case "", "none":
+		return nil, nil //nolint:nilnil // compression is disabled
+	case "gzip":
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, err
+		}
+	case "deflate":
+		if _, err := zlib.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", algorithm)
+	}
+	return &compressor{encoding: algorithm, level: level}, nil
+}
+
+// compress replaces the body with the compressed one, unless the content is already compressed
+// or the compression doesn't make it smaller
+func (c *compressor) compress(v *cached) {
+	if c == nil || v.Encoding != "" || len(v.Body) == 0 || !compressible(v.Header) {
+		return
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if c.encoding == "gzip" {
+		w, _ = gzip.NewWriterLevel(&buf, c.level) //nolint:errcheck // the level is validated
+	} else {
+		w, _ = zlib.NewWriterLevel(&buf, c.level) //nolint:errcheck // the level is validated
+	}
+	if _, err := w.Write(v.Body); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(v.Body) {
+		return
+	}
+
+	go metrics.Compression(len(v.Body), buf.Len())
+	v.Body = buf.Bytes()
+	v.Encoding = c.encoding
+}
+
+// adoptEncoding marks the body as encoded if the backend has compressed it with a supported algorithm,
+// so it's served decompressed to clients that don't accept the encoding
+func adoptEncoding(v *cached) {
+	encoding := v.Header.Get("Content-Encoding")
+	if encoding != "gzip" && encoding != "deflate" {
+		return
+	}
+	v.Header.Del("Content-Encoding")
+	v.Header.Del("Content-Length")
+	v.Encoding = encoding
+}
+
+// decompress returns the decoded body
+func decompress(v *cached) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch v.Encoding {
+	case "":
+		return v.Body, nil
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(v.Body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(v.Body))
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", v.Encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// decodedBody returns the response body decoded from its content coding, e.g. to verify the digest of a gzipped manifest.
+// The body is returned as is if the coding isn't supported
+func decodedBody(headers http.Header, body []byte) []byte {
+	encoding := headers.Get("Content-Encoding")
+	if encoding == "identity" {
+		return body
+	}
+	decoded, err := decompress(&cached{Body: body, Encoding: encoding})
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// compressible checks if the content is not compressed already
+func compressible(headers http.Header) bool {
+	if headers.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType, _, _ := mime.ParseMediaType(headers.Get("Content-Type")) //nolint:errcheck // empty on error
+	if compressedTypes[contentType] || strings.HasSuffix(contentType, "+gzip") || strings.HasSuffix(contentType, "+zstd") {
+		return false
+	}
+	major, _, _ := strings.Cut(contentType, "/")
+	return major != "image" && major != "video" && major != "audio"
+}
+
+// acceptsEncoding checks if the client accepts the content coding, see RFC 9110, section 12.5.3
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, encoding) && coding != "*" {
+				continue
+			}
+			if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
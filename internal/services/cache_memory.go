@@ -0,0 +1,315 @@
+package services
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// sketchDepth is the amount of count-min sketch rows
+const sketchDepth = 4
+
+// memoryStore is an in-memory cache store with a byte budget and expiration.
+// Eviction is LRU, but new entries are admitted only if they're requested more often
+// than the LRU victim (TinyLFU), so one-off scans don't evict hot entries.
+// Expired entries are kept for the grace period, available only with Stale()
+type memoryStore struct {
+	mu     sync.Mutex
+	budget int64
+	size   int64
+	ttl    time.Duration
+	grace  time.Duration
+	lru    *list.List
+	items  map[string]*list.Element
+	index  map[string]map[string]bool // repository -> keys, empty repository is for catalog and /v2/
+	sketch *sketch
+}
+
+type memoryItem struct {
+	key     string
+	value   cached
+	size    int64
+	expires time.Time
+}
+
+// newMemoryStore creates a new memoryStore, budget is in bytes
+func newMemoryStore(budget int64, ttl, grace time.Duration) *memoryStore {
+	return &memoryStore{
+		budget: budget,
+		ttl:    ttl,
+		grace:  grace,
+		lru:    list.New(),
+		items:  map[string]*list.Element{},
+		index:  map[string]map[string]bool{},
+		sketch: newSketch(budget),
+	}
+}
+
+// Get returns the entry and marks it as recently used, the access is counted for the admission
+func (m *memoryStore) Get(key string) (cached, bool) {
+	m.mu.Lock()
+	m.sketch.increment(key)
+	el, ok := m.items[key]
+	if !ok {
+		m.mu.Unlock()
+		return cached{}, false
+	}
+	item := el.Value.(*memoryItem) //nolint:forcetypeassert // list contains only *memoryItem
+	now := time.Now()
+	if now.After(item.expires.Add(m.grace)) {
+		m.removeElement(el)
+		m.mu.Unlock()
+		return cached{}, false
+	}
+	if now.After(item.expires) {
+		m.mu.Unlock()
+		return cached{}, false
+	}
+	m.lru.MoveToFront(el)
+	m.mu.Unlock()
+	return item.value, true
+}
+
+// Stale returns the entry even if it's expired, but still within the grace period,
+// along with the time passed since expiration (negative for fresh entries)
+func (m *memoryStore) Stale(key string) (cached, time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		return cached{}, 0, false
+	}
+	item := el.Value.(*memoryItem) //nolint:forcetypeassert // list contains only *memoryItem
+	expiredFor := time.Since(item.expires)
+	if expiredFor > m.grace {
+		return cached{}, 0, false
+	}
+	return item.value, expiredFor, true
+}
+
+// Peek returns the entry without updating its recency and frequency
+func (m *memoryStore) Peek(key string) (cached, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		return cached{}, false
+	}
+	item := el.Value.(*memoryItem) //nolint:forcetypeassert // list contains only *memoryItem
+	if time.Now().After(item.expires) {
+		return cached{}, false
+	}
+	return item.value, true
+}
+
+// Touch counts the access for the admission without returning the entry
+func (m *memoryStore) Touch(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sketch.increment(key)
+}
+
+// Add stores the entry until its expiration (or the store TTL), returns false if it wasn't admitted (too large or too rare to evict other entries)
+func (m *memoryStore) Add(key string, v cached) bool {
+	size := v.size()
+	if size > m.budget {
+		return false
+	}
+
+	expires := v.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(m.ttl)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item := &memoryItem{key: key, value: v, size: size, expires: expires}
+	if el, ok := m.items[key]; ok {
+		m.removeElement(el)
+		m.insert(item)
+		m.shrink()
+		return true
+	}
+
+	// admission: the candidate must be more frequent than every victim it would evict
+	var victims []*list.Element
+	free := m.budget - m.size
+	for el := m.lru.Back(); el != nil && free < size; el = el.Prev() {
+		victim := el.Value.(*memoryItem) //nolint:forcetypeassert // list contains only *memoryItem
+		expired := time.Now().After(victim.expires)
+		if !expired && m.sketch.estimate(key) <= m.sketch.estimate(victim.key) {
+			return false
+		}
+		victims = append(victims, el)
+		free += victim.size
+	}
+
+	for _, el := range victims {
+		m.removeElement(el)
+	}
+	m.insert(item)
+	return true
+}
+
+// Remove removes the entry, returns false if there was no such entry
+func (m *memoryStore) Remove(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if ok {
+		m.removeElement(el)
+	}
+	return ok
+}
+
+// Index returns keys of the repository entries, empty repository is for catalog and /v2/
+func (m *memoryStore) Index(repo string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.index[repo]))
+	for key := range m.index[repo] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Keys returns keys of all entries, including expired ones within the grace period, from the oldest to the newest
+func (m *memoryStore) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.items))
+	for el := m.lru.Back(); el != nil; el = el.Prev() {
+		keys = append(keys, el.Value.(*memoryItem).key) //nolint:forcetypeassert // list contains only *memoryItem
+	}
+	return keys
+}
+
+// Values returns all non-expired entries, from the oldest to the newest
+func (m *memoryStore) Values() []cached {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	values := make([]cached, 0, len(m.items))
+	for el := m.lru.Back(); el != nil; el = el.Prev() {
+		item := el.Value.(*memoryItem) //nolint:forcetypeassert // list contains only *memoryItem
+		if now.Before(item.expires) {
+			values = append(values, item.value)
+		}
+	}
+	return values
+}
+
+// Stats returns the amount of entries and their total size in bytes
+func (m *memoryStore) Stats() (entries int, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lru.Len(), m.size
+}
+
+// shrink evicts the least recently used entries above the budget, must be called with the lock held
+func (m *memoryStore) shrink() {
+	for m.size > m.budget {
+		el := m.lru.Back()
+		if el == nil {
+			break
+		}
+		m.removeElement(el)
+	}
+}
+
+// insert adds the entry to the front of the list and to the repository index, must be called with the lock held
+func (m *memoryStore) insert(item *memoryItem) {
+	m.items[item.key] = m.lru.PushFront(item)
+	m.size += item.size
+	repo := item.value.Repository
+	if m.index[repo] == nil {
+		m.index[repo] = map[string]bool{}
+	}
+	m.index[repo][item.key] = true
+}
+
+// removeElement removes the entry from the store and the repository index, must be called with the lock held
+func (m *memoryStore) removeElement(el *list.Element) {
+	item := el.Value.(*memoryItem) //nolint:forcetypeassert // list contains only *memoryItem
+	m.lru.Remove(el)
+	delete(m.items, item.key)
+	m.size -= item.size
+	repo := item.value.Repository
+	delete(m.index[repo], item.key)
+	if len(m.index[repo]) == 0 {
+		delete(m.index, repo)
+	}
+}
+
+// sketch is a count-min sketch with small saturating counters (up to 15) and periodic aging,
+// used to estimate access frequency of the keys
+type sketch struct {
+	seed      maphash.Seed
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newSketch creates a sketch sized for the expected amount of entries within the budget (~4KiB each)
+func newSketch(budget int64) *sketch {
+	width := uint64(1024)
+	for int64(width) < budget/4096 && width < 1<<24 {
+		width <<= 1
+	}
+	s := &sketch{seed: maphash.MakeSeed(), mask: width - 1, resetAt: int(width) * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) increment(key string) {
+	h := maphash.String(s.seed, key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.age()
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	h := maphash.String(s.seed, key)
+	low := uint8(15)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < low {
+			low = v
+		}
+	}
+	return low
+}
+
+// index returns the counter index of the hash in the row, using double hashing
+func (s *sketch) index(h uint64, row int) uint64 {
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+// age halves all counters, so old popularity fades away
+func (s *sketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
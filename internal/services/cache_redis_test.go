@@ -0,0 +1,495 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeRedis is an in-process redis stand-in, supporting the commands used by the redis store
+type fakeRedis struct {
+	t        *testing.T
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string][]byte
+	expires  map[string]time.Time
+	sets     map[string]map[string]bool
+	commands map[string]int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		t:        t,
+		listener: listener,
+		password: password,
+		values:   map[string][]byte{},
+		expires:  map[string]time.Time{},
+		sets:     map[string]map[string]bool{},
+		commands: map[string]int{},
+	}
+	go r.serve()
+	t.Cleanup(r.Close)
+	return r
+}
+
+// URL returns the redis URL of the server
+func (r *fakeRedis) URL() string {
+	if r.password != "" {
+		return "redis://:" + r.password + "@" + r.listener.Addr().String() + "/1"
+	}
+	return "redis://" + r.listener.Addr().String()
+}
+
+// Close stops the server, the clients get connection errors
+func (r *fakeRedis) Close() {
+	r.listener.Close()
+}
+
+// count returns the amount of the received commands
+func (r *fakeRedis) count(command string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commands[command]
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			authenticated = args[len(args)-1] == r.password
+		}
+		var reply string
+		if authenticated || command == "AUTH" {
+			reply = r.exec(command, args[1:])
+		} else {
+			reply = "-NOAUTH Authentication required.\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads the command as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("inline commands are not supported")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) exec(command string, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands[command]++
+	r.expire()
+	switch command {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := r.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(string(value))
+	case "SET":
+		r.values[args[0]] = []byte(args[1])
+		delete(r.expires, args[0])
+		if len(args) == 4 && strings.EqualFold(args[2], "PX") {
+			ms, _ := strconv.Atoi(args[3]) //nolint:errcheck // the client sends integers
+			if ms <= 0 {
+				delete(r.values, args[0])
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			r.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		var n int
+		for _, key := range args {
+			if r.exists(key) {
+				delete(r.values, key)
+				delete(r.sets, key)
+				delete(r.expires, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "EXISTS":
+		if r.exists(args[0]) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "STRLEN":
+		return ":" + strconv.Itoa(len(r.values[args[0]])) + "\r\n"
+	case "SADD":
+		if r.sets[args[0]] == nil {
+			r.sets[args[0]] = map[string]bool{}
+		}
+		for _, member := range args[1:] {
+			r.sets[args[0]][member] = true
+		}
+		return ":1\r\n"
+	case "SREM":
+		var n int
+		for _, member := range args[1:] {
+			if r.sets[args[0]][member] {
+				delete(r.sets[args[0]], member)
+				n++
+			}
+		}
+		if len(r.sets[args[0]]) == 0 {
+			delete(r.sets, args[0])
+			delete(r.expires, args[0])
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "SMEMBERS":
+		members := make([]string, 0, len(r.sets[args[0]]))
+		for member := range r.sets[args[0]] {
+			members = append(members, member)
+		}
+		return array(members)
+	case "PEXPIRE":
+		if !r.exists(args[0]) {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[1]) //nolint:errcheck // the client sends integers
+		r.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "PTTL":
+		if !r.exists(args[0]) {
+			return ":-2\r\n"
+		}
+		expires, ok := r.expires[args[0]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(time.Until(expires).Milliseconds(), 10) + "\r\n"
+	case "SCAN":
+		// a single page with all matching keys
+		prefix := strings.TrimSuffix(args[2], "*")
+		keys := []string{}
+		for key := range r.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return "*2\r\n" + bulk("0") + array(keys)
+	default:
+		return "-ERR unknown command '" + command + "'\r\n"
+	}
+}
+
+// expire removes the expired keys, must be called with the lock held
+func (r *fakeRedis) expire() {
+	for key, expires := range r.expires {
+		if time.Now().After(expires) {
+			delete(r.values, key)
+			delete(r.sets, key)
+			delete(r.expires, key)
+		}
+	}
+}
+
+// exists checks if the key is a value or a set, must be called with the lock held
+func (r *fakeRedis) exists(key string) bool {
+	_, ok := r.values[key]
+	return ok || r.sets[key] != nil
+}
+
+// ttl returns the time left until the key expires, 0 if it doesn't expire
+func (r *fakeRedis) ttl(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if expires, ok := r.expires[key]; ok {
+		return time.Until(expires)
+	}
+	return 0
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func array(values []string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(values))
+	for _, value := range values {
+		reply += bulk(value)
+	}
+	return reply
+}
+
+func TestRedisClient(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	client, err := newRedisClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do("SET", "key", "value\r\nwith a line break"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	reply, err := client.Do("GET", "key")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if value, ok := reply.([]byte); !ok || string(value) != "value\r\nwith a line break" {
+		t.Errorf("GET returned %q", reply)
+	}
+	if reply, err := client.Do("GET", "missing"); err != nil || reply != nil {
+		t.Errorf("GET of a missing key returned %v, %v, expected nil", reply, err)
+	}
+	if reply, err := client.Do("DEL", "key", "missing"); err != nil || reply != int64(1) {
+		t.Errorf("DEL returned %v, %v, expected 1", reply, err)
+	}
+
+	_, err = client.Do("UNKNOWN")
+	var rerr redisError
+	if !errors.As(err, &rerr) {
+		t.Errorf("error reply returned %v, expected redisError", err)
+	}
+
+	replies, err := client.Pipeline([][]string{{"SADD", "set", "a", "b"}, {"SMEMBERS", "set"}, {"UNKNOWN"}})
+	if err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+	if members := redisStrings(replies[1]); len(members) != 2 {
+		t.Errorf("SMEMBERS returned %v", members)
+	}
+	if _, ok := replies[2].(redisError); !ok {
+		t.Errorf("pipeline error reply returned %v, expected redisError", replies[2])
+	}
+	if server.count("SELECT") == 0 {
+		t.Error("db is not selected")
+	}
+}
+
+func TestRedisClientWrongPassword(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	client, err := newRedisClient("redis://:wrong@" + server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do("GET", "key"); err == nil {
+		t.Error("GET with a wrong password succeeded")
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newFakeRedis(t, "")
+	client, err := newRedisClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newRedisStore(client, "drp", "main", time.Hour, time.Hour)
+
+	fresh := cached{StatusCode: http.StatusOK, Header: http.Header{"Etag": {`"a"`}}, Body: []byte("fresh"), Repository: "foo"}
+	expired := cached{StatusCode: http.StatusOK, Body: []byte("expired"), Repository: "foo", Expires: time.Now().Add(-time.Minute)}
+	for key, v := range map[string]cached{"fresh": fresh, "expired": expired} {
+		if added, err := store.Add(key, v); err != nil || !added {
+			t.Fatalf("Add returned %v, %v", added, err)
+		}
+	}
+
+	if v, ok, err := store.Get("fresh"); err != nil || !ok || string(v.Body) != "fresh" || v.Header.Get("Etag") != `"a"` {
+		t.Errorf("Get returned %+v, %v, %v", v, ok, err)
+	}
+	if _, ok, err := store.Get("expired"); err != nil || ok {
+		t.Errorf("Get of the expired entry returned %v, %v", ok, err)
+	}
+	if v, expiredFor, ok, err := store.Stale("expired"); err != nil || !ok || expiredFor <= 0 || string(v.Body) != "expired" {
+		t.Errorf("Stale returned %+v, %s, %v, %v", v, expiredFor, ok, err)
+	}
+	if keys, err := store.Index("foo"); err != nil || len(keys) != 2 {
+		t.Errorf("Index returned %v, %v", keys, err)
+	}
+	if keys, err := store.Keys(); err != nil || len(keys) != 2 {
+		t.Errorf("Keys returned %v, %v", keys, err)
+	}
+	if values, err := store.Values(); err != nil || len(values) != 1 {
+		t.Errorf("Values returned %d entries, %v, expected only the fresh one", len(values), err)
+	}
+	if entries, size, err := store.Stats(); err != nil || entries != 2 || size == 0 {
+		t.Errorf("Stats returned %d, %d, %v", entries, size, err)
+	}
+	if ok, err := store.Remove("fresh"); err != nil || !ok {
+		t.Errorf("Remove returned %v, %v", ok, err)
+	}
+	if _, ok, _ := store.Get("fresh"); ok { //nolint:errcheck // checked above
+		t.Error("removed entry is still available")
+	}
+}
+
+func TestRedisStoreIndex(t *testing.T) {
+	server := newFakeRedis(t, "")
+	client, err := newRedisClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newRedisStore(client, "drp", "main", time.Hour, time.Minute)
+	index := "drp:main:repo:foo"
+
+	// the rule or upstream TTL is longer than the store one
+	long := cached{StatusCode: http.StatusOK, Repository: "foo", Expires: time.Now().Add(24 * time.Hour)}
+	if added, err := store.Add("long", long); err != nil || !added {
+		t.Fatalf("Add returned %v, %v", added, err)
+	}
+	if ttl := server.ttl(index); ttl < 24*time.Hour {
+		t.Errorf("index expires in %s, before its entry", ttl)
+	}
+	short := cached{StatusCode: http.StatusOK, Repository: "foo", Expires: time.Now().Add(time.Minute)}
+	if added, err := store.Add("short", short); err != nil || !added {
+		t.Fatalf("Add returned %v, %v", added, err)
+	}
+	if ttl := server.ttl(index); ttl < 24*time.Hour {
+		t.Errorf("index TTL is shortened to %s by the entry with a shorter TTL", ttl)
+	}
+
+	// expired beyond the grace period, the server would reject it
+	gone := cached{StatusCode: http.StatusOK, Repository: "foo", Expires: time.Now().Add(-time.Hour)}
+	if added, err := store.Add("gone", gone); err != nil || added {
+		t.Errorf("Add of the entry expired beyond the grace period returned %v, %v", added, err)
+	}
+	if server.count("SET") != 2 {
+		t.Errorf("%d SET commands sent, the expired entry must not be sent", server.count("SET"))
+	}
+
+	if ok, err := store.Remove("short"); err != nil || !ok {
+		t.Errorf("Remove returned %v, %v", ok, err)
+	}
+	server.mu.Lock()
+	delete(server.values, "drp:main:entry:long") // evicted by the server
+	server.mu.Unlock()
+	if keys, err := store.Index("foo"); err != nil || len(keys) != 0 {
+		t.Errorf("Index returned %v, %v, expected no keys", keys, err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if members := server.sets[index]; len(members) != 0 {
+		t.Errorf("index still has the removed and evicted entries: %v", members)
+	}
+}
+
+func TestSharedStoreFallback(t *testing.T) {
+	server := newFakeRedis(t, "")
+	client, err := newRedisClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := zerolog.Nop()
+	local := newMemoryStore(1024*1024, time.Hour, time.Hour)
+	shared := newSharedStore(newRedisStore(client, "drp", "main", time.Hour, time.Hour), local, &log)
+
+	shared.Add("remote", cached{StatusCode: http.StatusOK, Body: []byte("remote")})
+	if _, ok := local.Peek("remote"); ok {
+		t.Error("entry is stored locally while the shared store is available")
+	}
+	if v, ok := shared.Get("remote"); !ok || string(v.Body) != "remote" {
+		t.Errorf("Get returned %+v, %v", v, ok)
+	}
+
+	server.Close()
+	client.pool = make(chan *redisConn, redisPoolSize) // drop the idle connections to the closed server
+
+	if !shared.Add("local", cached{StatusCode: http.StatusOK, Body: []byte("local")}) {
+		t.Fatal("entry is not stored when the shared store is unavailable")
+	}
+	if shared.available() {
+		t.Error("shared store is still used after the failure")
+	}
+	if v, ok := shared.Get("local"); !ok || string(v.Body) != "local" {
+		t.Errorf("Get returned %+v, %v, expected the local entry", v, ok)
+	}
+}
+
+func TestSharedStoreStats(t *testing.T) {
+	server := newFakeRedis(t, "")
+	client, err := newRedisClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := zerolog.Nop()
+	local := newMemoryStore(1024*1024, time.Hour, time.Hour)
+	shared := newSharedStore(newRedisStore(client, "drp", "main", time.Hour, time.Hour), local, &log)
+	shared.Add("a", cached{StatusCode: http.StatusOK, Body: []byte("a")})
+
+	for i := 0; i < 5; i++ {
+		if entries, _ := shared.Stats(); entries != 1 {
+			t.Fatalf("Stats returned %d entries, expected 1", entries)
+		}
+	}
+	if scans := server.count("SCAN"); scans != 1 {
+		t.Errorf("%d keyspace scans for 5 stats calls, expected 1", scans)
+	}
+
+	server.Close()
+	client.pool = make(chan *redisConn, redisPoolSize)
+	shared.statsAt = time.Time{}
+	shared.Stats()
+	if !shared.available() {
+		t.Error("stats error switched the requests to the local store")
+	}
+}
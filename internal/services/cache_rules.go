@@ -0,0 +1,167 @@
+package services
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// defaultCacheRules are the cacheable endpoints of the Docker Registry API v2 specification
+var defaultCacheRules = []config.CacheRule{
+	{Name: "ping", Methods: []string{http.MethodGet, http.MethodHead}, Path: `^/v2/$`},
+	{Name: "catalog", Methods: []string{http.MethodGet}, Path: `^/v2/_catalog$`, Query: []string{"n", "last"}},
+	{Name: "tags", Methods: []string{http.MethodGet}, Path: `^/v2/.+/tags/list$`, Query: []string{"n", "last"}},
+	{Name: "manifests-digest", Methods: []string{http.MethodGet}, Path: `^/v2/.+/manifests/sha256:[a-f0-9]{64}$`},
+	{Name: "manifests-tag", Methods: []string{http.MethodGet}, Path: `^/v2/.+/manifests/[^/:]+$`},
+	{Name: "manifests-head", Methods: []string{http.MethodHead}, Path: `^/v2/.+/manifests/[^/]+$`},
+}
+
+// cacheRule describes a cacheable endpoint and how its responses are cached
+type cacheRule struct {
+	name       string
+	methods    map[string]bool
+	path       *regexp.Regexp
+	query      map[string]bool // allowed query params, nil allows any
+	statuses   map[int]bool
+	ttl        time.Duration // 0 for the store TTL
+	vary       []string      // canonical names of the request headers included into the cache key
+	immutable  bool          // digest-addressed content: verified and stored in the immutable store
+	revalidate bool          // tag-addressed content: revalidated with the backend after the freshness period
+	partition  bool          // responses depend on the client credentials, so they're cached per credentials
+}
+
+// newCacheRules compiles the custom rules followed by the default rules (unless disabled)
+func newCacheRules(custom []config.CacheRule, noDefault bool) ([]*cacheRule, error) {
+	rules := make([]*cacheRule, 0, len(custom)+len(defaultCacheRules))
+	for _, cfg := range custom {
+		rule, err := newCacheRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cache rule %q: %w", cfg.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	if noDefault {
+		return rules, nil
+	}
+
+	for _, cfg := range defaultCacheRules {
+		rule, err := newCacheRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cache rule %q: %w", cfg.Name, err)
+		}
+		rule.immutable = cfg.Name == "manifests-digest"
+		rule.revalidate = cfg.Name == "manifests-tag"
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newCacheRule(cfg config.CacheRule) (*cacheRule, error) {
+	path, err := regexp.Compile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+	statuses := cfg.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusOK, http.StatusNoContent}
+	}
+	vary := make([]string, 0, len(cfg.Vary))
+	for _, header := range cfg.Vary {
+		vary = append(vary, textproto.CanonicalMIMEHeaderKey(header))
+	}
+	if len(vary) == 0 {
+		vary = []string{acceptHeader}
+	}
+
+	rule := &cacheRule{
+		name:     cfg.Name,
+		methods:  utils.NewMap(methods, true),
+		path:     path,
+		statuses: utils.NewMap(statuses, true),
+		ttl:      time.Duration(cfg.TTL) * time.Minute,
+		vary:     vary,
+	}
+	if len(cfg.Query) != 1 || cfg.Query[0] != "*" {
+		rule.query = utils.NewMap(cfg.Query, true)
+	}
+	return rule, nil
+}
+
+// matchCacheRule returns the first rule matching the request, or nil if the request is not cacheable
+func matchCacheRule(rules []*cacheRule, req *http.Request) *cacheRule {
+	for _, rule := range rules {
+		if rule.match(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// match checks the method, path and that the request has only allowed query params
+func (r *cacheRule) match(req *http.Request) bool {
+	if !r.methods[req.Method] || !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.query == nil {
+		return true
+	}
+	for param := range req.URL.Query() {
+		if !r.query[param] {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the cache key: hash of the upstream, method, path, normalized query, the (normalized) vary headers,
+// and the client credentials if the rule is partitioned
+func (r *cacheRule) key(req *http.Request, upstream *Upstream) string {
+	hasher := sha256.New()
+	if upstream != nil {
+		// the same path may be routed to different upstreams by the request host
+		hasher.Write([]byte("Upstream:" + upstream.Name))
+	}
+	hasher.Write([]byte(req.Method))
+	hasher.Write([]byte(req.URL.Path))
+	hasher.Write([]byte(normalizeQuery(req.URL)))
+	if r.partition {
+		// credentials are hashed along with the rest of the key, so they're never stored as is
+		hasher.Write([]byte("Authorization:" + req.Header.Get("Authorization")))
+	}
+	for _, header := range r.vary {
+		// the same list may be sent as multiple headers or as a single comma-separated one
+		var values []string
+		for _, value := range req.Header[header] {
+			for _, item := range strings.Split(value, ",") {
+				values = append(values, strings.TrimSpace(item))
+			}
+		}
+		if len(values) > 0 {
+			sort.Strings(values)
+			hasher.Write([]byte(header + ":" + strings.Join(values, ",")))
+		}
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+// normalizeQuery returns the query with sorted params, so the same query with different order shares the cache entry
+func normalizeQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	return "?" + u.Query().Encode()
+}
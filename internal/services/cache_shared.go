@@ -0,0 +1,194 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+)
+
+const (
+	// sharedRetry is the period of using the local store after the shared store failure
+	sharedRetry = 10 * time.Second
+	// sharedStatsTTL is the period of reusing the shared store stats, collecting them scans the whole keyspace
+	sharedStatsTTL = time.Minute
+)
+
+// cacheStore is a storage of cached responses
+type cacheStore interface {
+	// Get returns the fresh entry
+	Get(key string) (cached, bool)
+	// Peek returns the fresh entry without updating its recency and frequency
+	Peek(key string) (cached, bool)
+	// Touch counts the access for the admission, for lookups that don't reach Get
+	Touch(key string)
+	// Stale returns the entry even if it's expired, along with the time passed since expiration
+	Stale(key string) (cached, time.Duration, bool)
+	// Add stores the entry, returns false if it wasn't admitted
+	Add(key string, v cached) bool
+	// Remove removes the entry, returns false if there was no such entry
+	Remove(key string) bool
+	// Index returns keys of the repository entries, empty repository is for catalog and /v2/
+	Index(repo string) []string
+	// Keys returns keys of all entries, including expired ones within the grace period
+	Keys() []string
+	// Values returns all non-expired entries
+	Values() []cached
+	// Stats returns the amount of entries and their total size in bytes
+	Stats() (int, int64)
+}
+
+// sharedStore uses the redis store shared by all proxy instances, and falls back to the local store
+// when the shared one is unavailable, retrying it after the sharedRetry period
+type sharedStore struct {
+	remote *redisStore
+	local  *memoryStore
+	log    *zerolog.Logger
+	mu     sync.Mutex
+	down   time.Time // the shared store is not used until this time
+
+	statsMu      sync.Mutex
+	statsAt      time.Time
+	statsEntries int
+	statsSize    int64
+}
+
+func newSharedStore(remote *redisStore, local *memoryStore, log *zerolog.Logger) *sharedStore {
+	return &sharedStore{remote: remote, local: local, log: log}
+}
+
+// available checks if the shared store should be used
+func (s *sharedStore) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Now().After(s.down)
+}
+
+// failed switches to the local store for the sharedRetry period, returns true if there was an error
+func (s *sharedStore) failed(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().After(s.down) {
+		s.log.Warn().Err(err).Str("retry", sharedRetry.String()).Msg("shared cache is unavailable, using local cache")
+	}
+	s.down = time.Now().Add(sharedRetry)
+	go metrics.SharedCacheError()
+	return true
+}
+
+func (s *sharedStore) Get(key string) (cached, bool) {
+	if s.available() {
+		v, ok, err := s.remote.Get(key)
+		if !s.failed(err) {
+			return v, ok
+		}
+	}
+	return s.local.Get(key)
+}
+
+func (s *sharedStore) Peek(key string) (cached, bool) {
+	if s.available() {
+		v, ok, err := s.remote.Get(key)
+		if !s.failed(err) {
+			return v, ok
+		}
+	}
+	return s.local.Peek(key)
+}
+
+// Touch counts the access in the local store, the shared store has no admission
+func (s *sharedStore) Touch(key string) {
+	s.local.Touch(key)
+}
+
+func (s *sharedStore) Stale(key string) (cached, time.Duration, bool) {
+	if s.available() {
+		v, expiredFor, ok, err := s.remote.Stale(key)
+		if !s.failed(err) {
+			return v, expiredFor, ok
+		}
+	}
+	return s.local.Stale(key)
+}
+
+func (s *sharedStore) Add(key string, v cached) bool {
+	if s.available() {
+		added, err := s.remote.Add(key, v)
+		if !s.failed(err) {
+			return added
+		}
+	}
+	return s.local.Add(key, v)
+}
+
+// Remove removes the entry from both stores, so entries cached locally during the outage are invalidated as well
+func (s *sharedStore) Remove(key string) bool {
+	removed := s.local.Remove(key)
+	if s.available() {
+		ok, err := s.remote.Remove(key)
+		if !s.failed(err) {
+			removed = removed || ok
+		}
+	}
+	return removed
+}
+
+// Index returns keys of the repository entries from both stores
+func (s *sharedStore) Index(repo string) []string {
+	keys := s.local.Index(repo)
+	if s.available() {
+		remote, err := s.remote.Index(repo)
+		if !s.failed(err) {
+			keys = append(keys, remote...)
+		}
+	}
+	return keys
+}
+
+func (s *sharedStore) Keys() []string {
+	if s.available() {
+		keys, err := s.remote.Keys()
+		if !s.failed(err) {
+			return keys
+		}
+	}
+	return s.local.Keys()
+}
+
+func (s *sharedStore) Values() []cached {
+	if s.available() {
+		values, err := s.remote.Values()
+		if !s.failed(err) {
+			return values
+		}
+	}
+	return s.local.Values()
+}
+
+// Stats returns the shared store stats, collected at most once per sharedStatsTTL.
+// Stats errors don't switch the requests to the local store, the local stats are returned instead
+func (s *sharedStore) Stats() (int, int64) {
+	if !s.available() {
+		return s.local.Stats()
+	}
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if time.Since(s.statsAt) < sharedStatsTTL {
+		return s.statsEntries, s.statsSize
+	}
+	entries, size, err := s.remote.Stats()
+	if err != nil {
+		s.log.Warn().Err(err).Msg("cannot collect shared cache stats")
+		entries, size = s.local.Stats()
+	}
+	s.statsAt, s.statsEntries, s.statsSize = time.Now(), entries, size
+	return entries, size
+}
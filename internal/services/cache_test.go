@@ -0,0 +1,258 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+// testCacheConfig is the cache config with 1MiB budgets and without compression, so the entry sizes are predictable
+func testCacheConfig() *config.Cache {
+	return &config.Cache{
+		TTL:             60,
+		Budget:          1,
+		EntryMax:        1024,
+		ImmutableTTL:    60,
+		ImmutableBudget: 1,
+		TagsFreshness:   30,
+		Stale:           60,
+		Compression:     "none",
+	}
+}
+
+// testBackend is a fake registry handler counting the requests
+type testBackend struct {
+	mu       sync.Mutex
+	requests map[string]int
+	body     func(path string) string
+	status   int
+	delay    time.Duration
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{requests: map[string]int{}, body: func(path string) string { return `{"path":"` + path + `"}` }}
+}
+
+func (b *testBackend) handler(c echo.Context) error {
+	b.mu.Lock()
+	b.requests[c.Request().Method+" "+c.Request().URL.Path]++
+	b.mu.Unlock()
+	time.Sleep(b.delay)
+	if b.status != 0 {
+		c.Set("resp.status", b.status)
+		return c.String(b.status, "backend failed")
+	}
+	body := b.body(c.Request().URL.Path)
+	c.Response().Header().Set("Content-Type", "application/json")
+	c.Response().Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body))))
+	c.Set("resp.status", http.StatusOK)
+	return c.String(http.StatusOK, body)
+}
+
+// serve sends the request through the middleware and returns the response
+func serve(e *echo.Echo, handler echo.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(method, target, http.NoBody), rec)
+	handler(c) //nolint:errcheck // the errors are written to the response
+	return rec
+}
+
+func TestCacheAdmitsFrequentTagManifestToFullStore(t *testing.T) {
+	log := zerolog.Nop()
+	cache := NewCache(testCacheConfig(), &log)
+	backend := newTestBackend()
+	backend.body = func(path string) string {
+		if strings.HasSuffix(path, "/tags/list") {
+			return `{"tags":["` + strings.Repeat("a", 100*1024) + `"]}`
+		}
+		// larger than the space left by the tag lists, so it must evict one of them
+		return `{"schemaVersion":2,"annotations":{"a":"` + strings.Repeat("a", 64*1024) + `"}}`
+	}
+	e := echo.New()
+	handler := cache.Middleware()(backend.handler)
+
+	// fill the store with one-off tag lists
+	for i := 0; i < 12; i++ {
+		serve(e, handler, http.MethodGet, fmt.Sprintf("/v2/repo%d/tags/list", i))
+	}
+
+	var xcache []string
+	for i := 0; i < 5; i++ {
+		rec := serve(e, handler, http.MethodGet, "/v2/foo/manifests/latest")
+		xcache = append(xcache, rec.Header().Get("X-Cache"))
+	}
+	if xcache[len(xcache)-1] != "HIT" {
+		t.Fatalf("frequently requested tag manifest was never admitted: %v", xcache)
+	}
+}
+
+func TestCachePurgeRemovesStaleEntries(t *testing.T) {
+	log := zerolog.Nop()
+	for _, filter := range []CachePurge{{Repository: "foo"}, {All: true}, {Pattern: "/v2/foo/*/list"}} {
+		cache := NewCache(testCacheConfig(), &log)
+		expired := cached{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       []byte(`{"tags":["latest"]}`),
+			Expires:    time.Now().Add(-time.Minute),
+			URL:        "/v2/foo/tags/list",
+			Repository: "foo",
+		}
+		cache.backend.Add("expired", expired)
+		if _, _, ok := cache.backend.Stale("expired"); !ok {
+			t.Fatal("expired entry is not kept for the grace period")
+		}
+
+		if purged := cache.Purge(filter); purged != 1 {
+			t.Errorf("%+v: purged %d entries, expected 1", filter, purged)
+		}
+		if _, _, ok := cache.backend.Stale("expired"); ok {
+			t.Errorf("%+v: purged entry is still served as stale", filter)
+		}
+	}
+}
+
+func TestCacheCoalescesRevalidations(t *testing.T) {
+	log := zerolog.Nop()
+	cfg := testCacheConfig()
+	cfg.TagsFreshness = 0 // every request revalidates the tag manifest
+	cache := NewCache(cfg, &log)
+	backend := newTestBackend()
+	e := echo.New()
+	handler := cache.Middleware()(backend.handler)
+
+	serve(e, handler, http.MethodGet, "/v2/foo/manifests/latest")
+	backend.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	xcache := make([]string, 10)
+	for i := range xcache {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			xcache[i] = serve(e, handler, http.MethodGet, "/v2/foo/manifests/latest").Header().Get("X-Cache")
+		}()
+	}
+	wg.Wait()
+
+	if heads := backend.requests["HEAD /v2/foo/manifests/latest"]; heads != 1 {
+		t.Errorf("%d revalidation requests sent to the backend, expected 1", heads)
+	}
+	if gets := backend.requests["GET /v2/foo/manifests/latest"]; gets != 1 {
+		t.Errorf("%d GET requests sent to the backend, expected 1", gets)
+	}
+	for _, x := range xcache {
+		if x != "HIT" {
+			t.Errorf("unchanged manifest served with X-Cache: %s, expected HIT", x)
+		}
+	}
+}
+
+// listingBackend is the backend of the tag list with the next page Link pointing at the public endpoint, as the proxy rewrites it
+func listingBackend(backend *testBackend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Link", "<"+PublicOf(c).String()+`/v2/foo/tags/list?last=a&n=1>; rel="next"`)
+		return backend.handler(c)
+	}
+}
+
+// serveListing sends the tag list request from a trusted proxy with the public host, returns the response
+func serveListing(e *echo.Echo, handler echo.HandlerFunc, host string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v2/foo/tags/list", http.NoBody)
+	req.RemoteAddr = "127.0.0.1:12345" // trusted proxy
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", host)
+	rec := httptest.NewRecorder()
+	handler(e.NewContext(req, rec)) //nolint:errcheck // the errors are written to the response
+	return rec
+}
+
+func TestCacheListingsServedToAnyPublicEndpoint(t *testing.T) {
+	log := zerolog.Nop()
+	cache := NewCache(testCacheConfig(), &log)
+	public := NewPublic(&config.Public{}, &log)
+	backend := newTestBackend()
+	e := echo.New()
+	handler := public.Middleware()(cache.Middleware()(listingBackend(backend)))
+
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		expected := "<https://" + host + `/v2/foo/tags/list?last=a&n=1>; rel="next"`
+		if link := serveListing(e, handler, host).Header().Get("Link"); link != expected {
+			t.Errorf("Link for %s is %s, expected %s", host, link, expected)
+		}
+	}
+	if gets := backend.requests["GET /v2/foo/tags/list"]; gets != 1 {
+		t.Errorf("%d requests sent to the backend, expected 1", gets)
+	}
+}
+
+func TestCacheWarmedListingHit(t *testing.T) {
+	log := zerolog.Nop()
+	cache := NewCache(testCacheConfig(), &log)
+	public := NewPublic(&config.Public{}, &log)
+	backend := newTestBackend()
+	e := echo.New()
+	// the warm-up handler skips the public endpoint middleware, as in the router
+	warmup := NewWarmup(&config.Warmup{Images: []string{"foo:none"}}, NewBlobs("", 0, false, &log), &log)
+	warmup.run(e, cache.Middleware()(listingBackend(backend)))
+
+	rec := serveListing(e, public.Middleware()(cache.Middleware()(listingBackend(backend))), "registry.example.com")
+	if xcache := rec.Header().Get("X-Cache"); xcache != "HIT" {
+		t.Errorf("warmed tag list served with X-Cache: %s, expected HIT", xcache)
+	}
+	if link, expected := rec.Header().Get("Link"), `<https://registry.example.com/v2/foo/tags/list?last=a&n=1>; rel="next"`; link != expected {
+		t.Errorf("Link of the warmed tag list is %s, expected %s", link, expected)
+	}
+}
+
+func TestCacheVerifiesCompressedManifests(t *testing.T) {
+	log := zerolog.Nop()
+	cache := NewCache(testCacheConfig(), &log)
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(manifest)) //nolint:errcheck // in-memory writer
+	gz.Close()
+
+	var requests int
+	e := echo.New()
+	handler := cache.Middleware()(func(c echo.Context) error {
+		requests++
+		c.Response().Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		c.Response().Header().Set("Content-Encoding", "gzip")
+		c.Set("resp.status", http.StatusOK)
+		return c.Blob(http.StatusOK, "application/vnd.oci.image.manifest.v1+json", gzipped.Bytes())
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/v2/foo/manifests/"+digest, http.NoBody)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler(e.NewContext(req, rec)) //nolint:errcheck // the errors are written to the response
+	}
+	if requests != 1 {
+		t.Errorf("%d requests sent to the backend, the gzipped manifest is not cached", requests)
+	}
+
+	// without the content digest, the ETag is the hash of the decoded body
+	req := httptest.NewRequest(http.MethodGet, "/v2/foo/tags/list", http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler(e.NewContext(req, httptest.NewRecorder())) //nolint:errcheck // the errors are written to the response
+	rec := serve(e, handler, http.MethodGet, "/v2/foo/tags/list")
+	if etag, expected := rec.Header().Get("Etag"), `"`+digest+`"`; etag != expected {
+		t.Errorf("ETag of the gzipped response is %s, expected %s", etag, expected)
+	}
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/errors"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// Modes of the proxy, ordered by strictness
+const (
+	ModeNormal      = "normal"      // all requests are passed to the upstreams
+	ModeReadOnly    = "read-only"   // write requests (PATCH, POST, PUT, DELETE) are rejected
+	ModeMaintenance = "maintenance" // all requests are rejected, except the cache hits
+)
+
+var modeLevels = map[string]int{ModeNormal: 0, ModeReadOnly: 1, ModeMaintenance: 2}
+
+// weekdays are the day names of the maintenance windows
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Mode is the runtime-switchable mode of the proxy: set via the admin API or signals,
+// or by the scheduled maintenance windows. The strictest of them applies
+type Mode struct {
+	mu      sync.RWMutex
+	manual  string
+	message string
+
+	defaultMessage string
+	windows        []modeWindow
+	windowsMode    string
+	log            *zerolog.Logger
+}
+
+// ModeState is the mode description for the admin API and the health endpoint
+type ModeState struct {
+	Mode      string `json:"mode"`              // effective mode
+	Manual    string `json:"manual"`            // mode set via the admin API or signals
+	Scheduled bool   `json:"scheduled"`         // a maintenance window is active
+	Message   string `json:"message,omitempty"` // message of the rejected requests
+}
+
+// modeWindow is a maintenance window in UTC, the window ends on the next day if the end is before the start
+type modeWindow struct {
+	day   time.Weekday
+	daily bool
+	start time.Duration // since midnight
+	end   time.Duration // since midnight
+}
+
+// NewMode creates a new Mode service
+func NewMode(cfg *config.Mode, log *zerolog.Logger) *Mode {
+	mode := &Mode{
+		manual:         ModeNormal,
+		defaultMessage: cfg.Message,
+		windowsMode:    cfg.ScheduleMode,
+		log:            log,
+	}
+	switch {
+	case cfg.Maintenance:
+		mode.manual = ModeMaintenance
+	case cfg.ReadOnly:
+		mode.manual = ModeReadOnly
+	}
+	if level, ok := modeLevels[mode.windowsMode]; !ok || level == 0 {
+		log.Error().Str("mode", mode.windowsMode).Msg("invalid mode of the maintenance windows, using read-only")
+		mode.windowsMode = ModeReadOnly
+	}
+	for _, item := range cfg.Schedule {
+		window, err := parseModeWindow(item)
+		if err != nil {
+			log.Error().Err(err).Str("window", item).Msg("invalid maintenance window, ignored")
+			continue
+		}
+		mode.windows = append(mode.windows, window)
+	}
+	return mode
+}
+
+// Set sets the mode, with an optional message of the rejected requests (the default one is used if empty)
+func (m *Mode) Set(mode, message string) error {
+	if _, ok := modeLevels[mode]; !ok {
+		return fmt.Errorf("unknown mode %q, must be one of: %s, %s, %s", mode, ModeNormal, ModeReadOnly, ModeMaintenance)
+	}
+	m.mu.Lock()
+	m.manual, m.message = mode, message
+	m.mu.Unlock()
+
+	m.log.Warn().Str("mode", mode).Str("message", message).Msg("mode changed")
+	return nil
+}
+
+// Toggle switches between the mode and the normal mode, used by signals
+func (m *Mode) Toggle(mode string) {
+	m.mu.RLock()
+	current := m.manual
+	m.mu.RUnlock()
+
+	if current == mode {
+		mode = ModeNormal
+	}
+	m.Set(mode, "") //nolint:errcheck // the modes are known
+}
+
+// State returns the current mode
+func (m *Mode) State() ModeState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state := ModeState{Mode: m.manual, Manual: m.manual}
+	if m.scheduled(time.Now()) {
+		state.Scheduled = true
+		if modeLevels[m.windowsMode] > modeLevels[state.Mode] {
+			state.Mode = m.windowsMode
+		}
+	}
+	if state.Mode != ModeNormal {
+		state.Message = m.message
+		if state.Message == "" {
+			state.Message = m.defaultMessage
+		}
+	}
+	return state
+}
+
+// Middleware rejects the requests not allowed in the current mode. It must be placed after the caches,
+// so the cache hits are served in the maintenance mode. The internal requests of the cache hits
+// (tag manifest revalidations and blob authorizations) are marked with "mode.exempt" and always allowed
+func (m *Mode) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if exempt, _ := c.Get("mode.exempt").(bool); exempt { //nolint:errcheck // false if not set
+				return next(c)
+			}
+			state := m.State()
+			switch state.Mode {
+			case ModeNormal:
+				return next(c)
+			case ModeReadOnly:
+				if !trustedMethods[c.Request().Method] {
+					return next(c)
+				}
+			case ModeMaintenance:
+				// the stale cache entry is better than nothing
+				if fallback, ok := c.Get("proxy.fallback").(func()); ok {
+					fallback()
+					return nil
+				}
+			}
+
+			utils.NewLog(c).Info().Str("mode", state.Mode).Msg("rejected by the mode")
+			err := errors.NewError("UNAVAILABLE", state.Message)
+			err.HTTPCode = http.StatusServiceUnavailable
+			(&errors.Response{Errors: []*errors.Error{err}}).WriteTo(c.Request().Context(), c.Response())
+			return nil
+		}
+	}
+}
+
+// scheduled checks if a maintenance window is active
+func (m *Mode) scheduled(now time.Time) bool {
+	for _, window := range m.windows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseModeWindow parses the maintenance window, e.g. sun@02:00-04:00, or 03:00-03:30 for the daily window
+func parseModeWindow(value string) (modeWindow, error) {
+	var window modeWindow
+	day, span, ok := strings.Cut(strings.ToLower(value), "@")
+	if ok {
+		if window.day, ok = weekdays[day]; !ok {
+			return window, fmt.Errorf("unknown day %q", day)
+		}
+	} else {
+		span, window.daily = day, true
+	}
+	start, end, ok := strings.Cut(span, "-")
+	if !ok {
+		return window, fmt.Errorf("the window must be start-end, e.g. 02:00-04:00")
+	}
+	var err error
+	if window.start, err = parseClock(start); err != nil {
+		return window, err
+	}
+	if window.end, err = parseClock(end); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("the window is empty, the start must differ from the end")
+	}
+	return window, nil
+}
+
+// parseClock parses the time of the day, e.g. 02:30
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+func (w modeWindow) contains(now time.Time) bool {
+	now = now.UTC()
+	offset := now.Sub(now.Truncate(24 * time.Hour))
+	if w.start <= w.end {
+		return w.onDay(now.Weekday()) && offset >= w.start && offset < w.end
+	}
+	// the window ends on the next day
+	return (w.onDay(now.Weekday()) && offset >= w.start) || (w.onDay((now.Weekday()+6)%7) && offset < w.end)
+}
+
+func (w modeWindow) onDay(day time.Weekday) bool {
+	return w.daily || w.day == day
+}
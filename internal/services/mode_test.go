@@ -0,0 +1,183 @@
+package services
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+func TestModeSwitching(t *testing.T) {
+	log := zerolog.Nop()
+	mode := NewMode(&config.Mode{Message: "planned maintenance", ScheduleMode: ModeReadOnly}, &log)
+	if state := mode.State(); state.Mode != ModeNormal || state.Message != "" {
+		t.Errorf("initial state is %+v, expected the normal mode", state)
+	}
+
+	if err := mode.Set(ModeReadOnly, ""); err != nil {
+		t.Fatal(err)
+	}
+	if state := mode.State(); state.Mode != ModeReadOnly || state.Message != "planned maintenance" {
+		t.Errorf("state is %+v, expected read-only with the default message", state)
+	}
+	if err := mode.Set("off", ""); err == nil || mode.State().Mode != ModeReadOnly {
+		t.Error("unknown mode is accepted")
+	}
+
+	mode.Toggle(ModeMaintenance)
+	if state := mode.State(); state.Mode != ModeMaintenance {
+		t.Errorf("toggled state is %+v, expected maintenance", state)
+	}
+	mode.Toggle(ModeMaintenance)
+	if state := mode.State(); state.Mode != ModeNormal {
+		t.Errorf("toggled back state is %+v, expected normal", state)
+	}
+}
+
+func TestModeScheduled(t *testing.T) {
+	log := zerolog.Nop()
+	now := time.Now().UTC()
+	window := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	mode := NewMode(&config.Mode{ReadOnly: true, Schedule: []string{window}, ScheduleMode: ModeMaintenance}, &log)
+
+	state := mode.State()
+	if state.Mode != ModeMaintenance || state.Manual != ModeReadOnly || !state.Scheduled {
+		t.Errorf("state in the window %s is %+v, expected the scheduled maintenance", window, state)
+	}
+}
+
+func TestModeMiddleware(t *testing.T) {
+	log := zerolog.Nop()
+	mode := NewMode(&config.Mode{ScheduleMode: ModeReadOnly}, &log)
+	cache := NewCache(testCacheConfig(), &log)
+	backend := newTestBackend()
+	e := echo.New()
+	handler := cache.Middleware()(mode.Middleware()(backend.handler))
+
+	mode.Set(ModeReadOnly, "read-only for the migration") //nolint:errcheck // the mode is known
+	if rec := serve(e, handler, http.MethodGet, "/v2/foo/tags/list"); rec.Code != http.StatusOK {
+		t.Errorf("read request is rejected in the read-only mode: %d", rec.Code)
+	}
+	rec := serve(e, handler, http.MethodPut, "/v2/foo/manifests/latest")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "UNAVAILABLE") || !strings.Contains(rec.Body.String(), "read-only for the migration") {
+		t.Errorf("write request in the read-only mode got %d %s, expected 503 UNAVAILABLE with the message", rec.Code, rec.Body.String())
+	}
+
+	mode.Set(ModeMaintenance, "") //nolint:errcheck // the mode is known
+	if rec := serve(e, handler, http.MethodGet, "/v2/foo/tags/list"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("cached response is not served in the maintenance mode: %d %s", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if rec := serve(e, handler, http.MethodGet, "/v2/bar/tags/list"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("uncached request is not rejected in the maintenance mode: %d", rec.Code)
+	}
+	if requests := backend.requests["GET /v2/foo/tags/list"] + backend.requests["GET /v2/bar/tags/list"] + backend.requests["PUT /v2/foo/manifests/latest"]; requests != 1 {
+		t.Errorf("%d requests sent to the backend, expected 1", requests)
+	}
+}
+
+func TestModeMaintenanceRevalidatesCacheHits(t *testing.T) {
+	log := zerolog.Nop()
+	mode := NewMode(&config.Mode{ScheduleMode: ModeReadOnly}, &log)
+	cfg := testCacheConfig()
+	cfg.TagsFreshness = 0 // every request revalidates the tag manifest
+	cache := NewCache(cfg, &log)
+	backend := newTestBackend()
+	e := echo.New()
+	handler := cache.Middleware()(mode.Middleware()(backend.handler))
+
+	serve(e, handler, http.MethodGet, "/v2/foo/manifests/latest")
+	mode.Set(ModeMaintenance, "") //nolint:errcheck // the mode is known
+	rec := serve(e, handler, http.MethodGet, "/v2/foo/manifests/latest")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("cached tag manifest in the maintenance mode got %d %s, expected HIT", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if heads := backend.requests["HEAD /v2/foo/manifests/latest"]; heads != 1 {
+		t.Errorf("%d revalidation requests sent to the backend, expected 1", heads)
+	}
+}
+
+func TestModeMaintenanceAuthorizesBlobHits(t *testing.T) {
+	log := zerolog.Nop()
+	mode := NewMode(&config.Mode{ScheduleMode: ModeReadOnly}, &log)
+	blobs := NewBlobs(t.TempDir(), 1, true, &log)
+	backend := newTestBackend()
+	backend.body = func(string) string { return "blob" }
+	e := echo.New()
+	handler := blobs.Middleware()(mode.Middleware()(backend.handler))
+	endpoint := fmt.Sprintf("/v2/foo/blobs/sha256:%x", sha256.Sum256([]byte("blob")))
+
+	serve(e, handler, http.MethodGet, endpoint)
+	mode.Set(ModeMaintenance, "") //nolint:errcheck // the mode is known
+	rec := serve(e, handler, http.MethodGet, endpoint)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("cached blob in the maintenance mode got %d %s, expected HIT", rec.Code, rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestModeMiddlewareServesStaleEntries(t *testing.T) {
+	log := zerolog.Nop()
+	mode := NewMode(&config.Mode{Maintenance: true, ScheduleMode: ModeReadOnly}, &log)
+	var served bool
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/v2/foo/tags/list", http.NoBody), httptest.NewRecorder())
+	c.Set("proxy.fallback", func() { served = true })
+	if err := mode.Middleware()(func(echo.Context) error {
+		t.Error("request is passed to the upstream in the maintenance mode")
+		return nil
+	})(c); err != nil {
+		t.Fatal(err)
+	}
+	if !served {
+		t.Error("stale cache entry is not served in the maintenance mode")
+	}
+}
+
+func TestModeWindow(t *testing.T) {
+	// at returns the time of the day of the first week of 2023, it starts on Sunday, e.g. Mon 03:00
+	at := func(value string) time.Time {
+		day, clock, _ := strings.Cut(strings.ToLower(value), " ")
+		offset, err := parseClock(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2023, time.January, 1+int(weekdays[day]), 0, 0, 0, 0, time.UTC).Add(offset)
+	}
+	tests := map[string]struct {
+		inside  []string
+		outside []string
+	}{
+		"sun@02:00-04:00": {[]string{"Sun 02:00", "Sun 03:59"}, []string{"Sun 04:00", "Mon 03:00", "Sun 01:59"}},
+		"03:00-03:30":     {[]string{"Mon 03:00", "Sat 03:29"}, []string{"Mon 03:30", "Tue 02:59"}},
+		"sat@23:00-01:00": {[]string{"Sat 23:30", "Sun 00:30"}, []string{"Sat 00:30", "Sun 23:30", "Sun 01:00"}},
+	}
+	for value, test := range tests {
+		window, err := parseModeWindow(value)
+		if err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+		for _, now := range test.inside {
+			if !window.contains(at(now)) {
+				t.Errorf("%s doesn't contain %s", value, now)
+			}
+		}
+		for _, now := range test.outside {
+			if window.contains(at(now)) {
+				t.Errorf("%s contains %s", value, now)
+			}
+		}
+	}
+
+	for _, value := range []string{"someday@02:00-04:00", "02:00", "25:00-26:00", "sun@02:00-4pm", "02:00-02:00"} {
+		if _, err := parseModeWindow(value); err == nil {
+			t.Errorf("invalid window %s is accepted", value)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+var (
+	// listEndpoint matches the paginated endpoints: catalog and tag lists
+	listEndpoint = regexp.MustCompile(`^/v2/(?:_catalog|.+/tags/list)$`)
+	// nextLink captures the next page URL from the Link header, e.g. </v2/_catalog?last=a&n=1>; rel="next"
+	nextLink = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?next"?`)
+)
+
+// Pagination is a middleware that assembles full paginated listings (catalog and tag lists)
+// for clients that don't follow pagination, i.e. requests without the n and last query params.
+// Pages are fetched through the rest of the chain, so each of them is cached individually
+type Pagination struct {
+	enabled  bool
+	maxPages int
+}
+
+// NewPagination returns a new Pagination instance
+func NewPagination(cfg *config.Pagination) *Pagination {
+	return &Pagination{
+		enabled:  cfg.Assemble,
+		maxPages: cfg.MaxPages,
+	}
+}
+
+// Middleware returns a new echo.MiddlewareFunc that assembles paginated listings
+func (p *Pagination) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if !p.enabled || req.Method != http.MethodGet || !listEndpoint.MatchString(req.URL.Path) {
+				return next(c)
+			}
+			if query := req.URL.Query(); query.Has("n") || query.Has("last") {
+				return next(c)
+			}
+			// the first page alone can't be used to answer conditional requests for the full listing,
+			// and the pages must be decoded to be assembled
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+			req.Header.Del("Accept-Encoding")
+
+			w := c.Response().Writer
+			first := &bufferWriter{discardWriter: discardWriter{header: http.Header{}}, keep: true}
+			c.Response().Writer = first
+			err := next(c)
+			c.Response().Writer = w
+			if !c.Response().Committed {
+				return err
+			}
+			link := nextPage(first.header.Get("Link"))
+			if err != nil || c.Response().Status != http.StatusOK || link == nil {
+				writeBuffered(w, first, c.Response().Status)
+				return err
+			}
+
+			log := utils.NewLog(c)
+			listing := map[string]json.RawMessage{}
+			items, key, ok := listItems(first.body.Bytes(), listing)
+			if !ok {
+				log.Warn().Msg("cannot parse the first page, pagination is not assembled")
+				writeBuffered(w, first, http.StatusOK)
+				return nil
+			}
+
+			pages := 1
+			for ; link != nil && pages < p.maxPages; pages++ {
+				hc := internalContext(c, http.MethodGet)
+				// the link points at the public endpoint, which may have a path prefix
+				hc.Request().URL.Path = strings.TrimPrefix(link.Path, PublicOf(c).Path)
+				hc.Request().URL.RawQuery = link.RawQuery
+				page := &bufferWriter{discardWriter: discardWriter{header: http.Header{}}, keep: true}
+				hc.Response().Writer = page
+				if err := next(hc); err != nil || hc.Response().Status != http.StatusOK {
+					log.Warn().Err(err).Int("status", hc.Response().Status).Str("page", link.String()).Msg("cannot fetch the page, pagination is not assembled")
+					writeBuffered(w, first, http.StatusOK)
+					return nil
+				}
+				pageItems, _, ok := listItems(page.body.Bytes(), map[string]json.RawMessage{})
+				if !ok {
+					log.Warn().Str("page", link.String()).Msg("cannot parse the page, pagination is not assembled")
+					writeBuffered(w, first, http.StatusOK)
+					return nil
+				}
+				items = append(items, pageItems...)
+				link = nextPage(page.header.Get("Link"))
+			}
+
+			body, err := assembleListing(listing, key, items)
+			if err != nil {
+				writeBuffered(w, first, http.StatusOK)
+				return nil //nolint:nilerr // the first page is served instead
+			}
+			headers := first.header
+			headers.Del("Link")
+			headers.Del("Etag")
+			headers.Del("Last-Modified")
+			if link != nil {
+				// the listing is incomplete, so the client may continue from the last page
+				log.Warn().Int("pages", pages).Msg("max pages reached, pagination is assembled partially")
+				headers.Set("Link", "<"+link.String()+`>; rel="next"`)
+			}
+			headers.Set("Content-Length", strconv.Itoa(len(body)))
+			log.Debug().Int("pages", pages).Int("items", len(items)).Msg("pagination assembled")
+			first.body.Reset()
+			first.body.Write(body)
+			writeBuffered(w, first, http.StatusOK)
+			return nil
+		}
+	}
+}
+
+// nextPage returns the next page URL from the Link header, or nil if there is no next page
+func nextPage(link string) *url.URL {
+	match := nextLink.FindStringSubmatch(link)
+	if match == nil {
+		return nil
+	}
+	next, err := url.Parse(match[1])
+	if err != nil {
+		return nil
+	}
+	return next
+}
+
+// listItems parses the page into the listing fields, and returns items of the list field: repositories (catalog) or tags
+func listItems(body []byte, listing map[string]json.RawMessage) (items []string, key string, ok bool) {
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return nil, "", false
+	}
+	for _, key = range []string{"repositories", "tags"} {
+		if raw, found := listing[key]; found {
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, "", false
+			}
+			return items, key, true
+		}
+	}
+	return nil, "", false
+}
+
+// assembleListing puts all items into the list field of the first page
+func assembleListing(listing map[string]json.RawMessage, key string, items []string) ([]byte, error) {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	listing[key] = raw
+	return json.Marshal(listing)
+}
+
+// writeBuffered writes the buffered response to the writer
+func writeBuffered(w http.ResponseWriter, buf *bufferWriter, status int) {
+	for k, v := range buf.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	w.Write(buf.body.Bytes()) //nolint:errcheck // ignore error
+}
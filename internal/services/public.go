@@ -0,0 +1,132 @@
+package services
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+// Public resolves the public endpoint of the proxy (scheme, host and path prefix) the clients use,
+// so the upstream URLs in the response headers (Location, Link, WWW-Authenticate realm) point at it.
+// The endpoint is the configured base URL, or the request's own one, honoring the X-Forwarded-Proto and X-Forwarded-Host
+// headers of the trusted proxies (loopback, link-local and private networks, and the configured proxies)
+type Public struct {
+	base    *url.URL
+	proxies []*net.IPNet
+}
+
+// NewPublic creates a new Public service
+func NewPublic(cfg *config.Public, log *zerolog.Logger) *Public {
+	public := &Public{}
+	if cfg.URL != "" {
+		base, err := url.Parse(cfg.URL)
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			log.Error().Err(err).Str("url", cfg.URL).Msg("invalid public URL, the request endpoint is used")
+		} else {
+			base.Path = strings.TrimSuffix(base.Path, "/")
+			base.RawPath, base.RawQuery, base.Fragment = "", "", ""
+			public.base = base
+		}
+	}
+	for _, proxy := range cfg.Proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Error().Err(err).Str("proxy", proxy).Msg("invalid trusted proxy, ignored")
+			continue
+		}
+		public.proxies = append(public.proxies, network)
+	}
+	return public
+}
+
+// TrustOptions returns the configured proxies as the trust options of the echo IP extractor
+func (p *Public) TrustOptions() []echo.TrustOption {
+	options := make([]echo.TrustOption, 0, len(p.proxies))
+	for _, network := range p.proxies {
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return options
+}
+
+// Middleware resolves the public endpoint of the request
+func (p *Public) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("public", p.endpoint(c))
+			return next(c)
+		}
+	}
+}
+
+// PublicOf returns the public endpoint of the request, the request's own one if it wasn't resolved (e.g. internal requests)
+func PublicOf(c echo.Context) *url.URL {
+	if public, ok := c.Get("public").(*url.URL); ok {
+		return public
+	}
+	return &url.URL{Scheme: requestScheme(c), Host: c.Request().Host}
+}
+
+// endpoint returns the configured base URL, or the request endpoint
+func (p *Public) endpoint(c echo.Context) *url.URL {
+	if p.base != nil {
+		return p.base
+	}
+	endpoint := &url.URL{Scheme: requestScheme(c), Host: c.Request().Host}
+	if !p.trusted(c.Request().RemoteAddr) {
+		return endpoint
+	}
+	if proto := forwarded(c.Request().Header.Get(echo.HeaderXForwardedProto)); proto == "http" || proto == "https" {
+		endpoint.Scheme = proto
+	}
+	if host := forwarded(c.Request().Header.Get("X-Forwarded-Host")); host != "" {
+		endpoint.Host = host
+	}
+	return endpoint
+}
+
+// trusted checks if the request comes directly from a trusted proxy
+func (p *Public) trusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate() {
+		return true
+	}
+	for _, network := range p.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme returns the scheme of the connection, unlike echo.Context.Scheme it doesn't trust the headers
+func requestScheme(c echo.Context) string {
+	if c.IsTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// forwarded returns the value of the first (client-facing) proxy of the chain, e.g. https, http -> https
+func forwarded(value string) string {
+	value, _, _ = strings.Cut(value, ",")
+	return strings.TrimSpace(value)
+}
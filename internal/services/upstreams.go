@@ -0,0 +1,227 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/etkecc/go-apm"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// Upstream is a backend registry with its routing, auth and cache settings
+type Upstream struct {
+	Name           string
+	Target         config.Target
+	Transport      http.RoundTripper
+	hosts          map[string]bool
+	prefix         string
+	upstreamPrefix string
+	cacheDisabled  bool
+	cacheTTL       time.Duration
+	cancelable     bool // read requests are canceled when the client disconnects
+	pool           *upstreamPool
+	log            *zerolog.Logger
+}
+
+// Upstreams is a middleware that routes requests to the upstream registries by the request Host header
+// or by the repository prefix (e.g. /v2/hub/library/alpine/...), falling back to the default upstream
+type Upstreams struct {
+	list     []*Upstream
+	fallback *Upstream
+}
+
+// NewUpstreams returns a new Upstreams instance, the default upstream is the first one without hosts and prefix,
+// or the first one if all upstreams have them. Health checks of the pools with multiple members are started in the background
+func NewUpstreams(cfg []config.Upstream, poolCfg *config.Pool, retryCfg *config.Retry, transportCfg *config.Transport, log *zerolog.Logger) *Upstreams {
+	upstreams := &Upstreams{list: make([]*Upstream, 0, len(cfg))}
+	for _, item := range cfg {
+		if item.Target.Hub && item.Target.Host == "" {
+			item.Target.Host = hubHost
+		}
+		if item.Target.Hub && item.Target.Scheme == "" {
+			item.Target.Scheme = "https"
+		}
+		base, transport := newUpstreamHTTPTransport(item.Name, item.Target, transportCfg, log)
+		upstream := &Upstream{
+			Name:           item.Name,
+			Target:         item.Target,
+			Transport:      newUpstreamTransport(item.Name, item.Target, retryCfg, apm.WrapRoundTripper(base, apm.WithMaxRetries(0)), log),
+			hosts:          utils.NewMap(item.Hosts, true),
+			prefix:         strings.Trim(item.Prefix, "/"),
+			upstreamPrefix: strings.Trim(item.UpstreamPrefix, "/"),
+			cacheDisabled:  item.CacheDisabled,
+			cacheTTL:       time.Duration(item.CacheTTL) * time.Minute,
+			cancelable:     transportCfg.CancelOnDisconnect,
+			pool:           newUpstreamPool(item.Name, item.Target, poolCfg, log),
+			log:            log,
+		}
+		if upstream.Target.Host == "" {
+			log.Warn().Str("upstream", upstream.Name).Msg("upstream host is not set")
+		}
+		if len(upstream.pool.members) > 1 && poolCfg.HealthInterval > 0 {
+			go upstream.pool.check(transport, time.Duration(poolCfg.HealthInterval)*time.Second, time.Duration(poolCfg.HealthTimeout)*time.Second, log)
+		}
+		upstreams.list = append(upstreams.list, upstream)
+		if upstreams.fallback == nil && len(upstream.hosts) == 0 && upstream.prefix == "" {
+			upstreams.fallback = upstream
+		}
+	}
+	if upstreams.fallback == nil && len(upstreams.list) > 0 {
+		upstreams.fallback = upstreams.list[0]
+	}
+	return upstreams
+}
+
+// Middleware returns a new echo.MiddlewareFunc that sets the upstream of the request, see UpstreamOf
+func (u *Upstreams) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			upstream := u.route(c.Request().Host, c.Request().URL.Path)
+			if upstream != nil && upstream.Target.Hub {
+				c.Request().URL.Path = hubNormalize(c.Request().URL.Path, upstream.prefix)
+				c.Request().URL.RawPath = ""
+			}
+			c.Set("upstream", upstream)
+			return next(c)
+		}
+	}
+}
+
+// newUpstreamTransport adds the upstream features to the base transport: Docker Hub rate limits tracking,
+// authentication with the upstream credentials, following the storage (or Docker Hub CDN) redirects, and retries
+func newUpstreamTransport(name string, target config.Target, retryCfg *config.Retry, base http.RoundTripper, log *zerolog.Logger) http.RoundTripper {
+	transport := newRetryTransport(base, name, retryCfg, log)
+	if target.Hub || target.FollowRedirects {
+		transport = newRedirectTransport(transport, name, redirectHosts(target), log)
+	}
+	if target.Hub || target.Username != "" {
+		transport = newTokenTransport(transport, target.Username, target.Password)
+	}
+	if target.Hub {
+		transport = &hubTransport{next: transport, upstream: name, log: log}
+	}
+	return transport
+}
+
+// redirectHosts returns the allowed redirect destinations: the configured ones, or the upstream hosts
+// (and the Docker Hub CDN in the hub mode), so the proxy can't be redirected to arbitrary hosts
+func redirectHosts(target config.Target) []string {
+	if len(target.RedirectHosts) > 0 {
+		return target.RedirectHosts
+	}
+	hosts := append([]string{target.Host}, target.Members...)
+	if target.Hub {
+		hosts = append(hosts, hubRedirectHosts...)
+	}
+	return hosts
+}
+
+// route returns the upstream of the request host, or the upstream of the repository prefix, or the default upstream
+func (u *Upstreams) route(host, path string) *Upstream {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	for _, upstream := range u.list {
+		if upstream.hosts[host] {
+			return upstream
+		}
+	}
+	for _, upstream := range u.list {
+		if upstream.prefix != "" && strings.HasPrefix(path, "/v2/"+upstream.prefix+"/") {
+			return upstream
+		}
+	}
+	return u.fallback
+}
+
+// UpstreamOf returns the upstream of the request, nil if the request wasn't routed
+func UpstreamOf(c echo.Context) *Upstream {
+	upstream, _ := c.Get("upstream").(*Upstream) //nolint:errcheck // nil if not set
+	return upstream
+}
+
+// Detached checks if the upstream request must outlive the client request: write requests always do,
+// read requests do unless they're canceled on client disconnects
+func (u *Upstream) Detached(req *http.Request) bool {
+	return !u.cancelable || (req.Method != http.MethodGet && req.Method != http.MethodHead)
+}
+
+// Pick returns the pool member to send the request to, skipping the tried ones (failover), nil if there is none
+func (u *Upstream) Pick(req *http.Request, tried map[*UpstreamMember]bool) *UpstreamMember {
+	return u.pool.pick(repository(req.URL.Path), tried)
+}
+
+// CanFailover checks if the request may be retried with another pool member
+func (u *Upstream) CanFailover(tried map[*UpstreamMember]bool) bool {
+	return u.pool.canFailover(tried)
+}
+
+// Start marks the request to the member as in-flight, must be followed by Done
+func (u *Upstream) Start(member *UpstreamMember) {
+	u.pool.start(member)
+}
+
+// Done records the result of the request to the member: ok is false for connection errors and 5xx responses
+func (u *Upstream) Done(member *UpstreamMember, ok bool) {
+	u.pool.done(member, ok, u.log)
+}
+
+// Internal checks if the host (e.g. of the Location header) is the upstream host or a member of its pool
+func (u *Upstream) Internal(host string) bool {
+	if host == u.Target.Host {
+		return true
+	}
+	for _, member := range u.pool.members {
+		if member.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamPath converts the client-facing path to the upstream one: the prefix is stripped, and the upstream prefix is added,
+// e.g. /v2/hub/alpine/manifests/latest -> /v2/library/alpine/manifests/latest.
+// The API root and the catalog are kept as is
+func (u *Upstream) UpstreamPath(path string) string {
+	name, ok := repositoryPath(path)
+	if !ok {
+		return path
+	}
+	if u.prefix != "" {
+		name = strings.TrimPrefix(name, u.prefix+"/")
+	}
+	if u.upstreamPrefix != "" {
+		name = u.upstreamPrefix + "/" + name
+	}
+	return "/v2/" + name
+}
+
+// ClientPath converts the upstream path (e.g. of the Location and Link headers) back to the client-facing one
+func (u *Upstream) ClientPath(path string) string {
+	name, ok := repositoryPath(path)
+	if !ok {
+		return path
+	}
+	if u.upstreamPrefix != "" {
+		name = strings.TrimPrefix(name, u.upstreamPrefix+"/")
+	}
+	if u.prefix != "" {
+		name = u.prefix + "/" + name
+	}
+	return "/v2/" + name
+}
+
+// repositoryPath returns the path after /v2/ if it's a repository endpoint (not the API root or the catalog)
+func repositoryPath(path string) (string, bool) {
+	name, ok := strings.CutPrefix(path, "/v2/")
+	if !ok || name == "" || name == "_catalog" {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenDefaultTTL is the token lifetime if the token endpoint doesn't specify it, see the distribution token spec
+	tokenDefaultTTL = 60 * time.Second
+	// tokenTimeout is the timeout of the token requests
+	tokenTimeout = 10 * time.Second
+)
+
+// challengeParam captures the params of the WWW-Authenticate header, e.g. realm="https://auth.docker.io/token"
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// upstreamToken is a cached bearer token
+type upstreamToken struct {
+	value   string
+	expires time.Time
+}
+
+// tokenTransport authenticates the requests to the upstream with its credentials: it answers the upstream challenges
+// (Bearer token or Basic), caches the tokens per scope until expiration (expired ones are evicted), and strips the challenges
+// from the responses, so clients deal with the proxy's own auth only. Client credentials are never passed to the upstream
+type tokenTransport struct {
+	next     http.RoundTripper
+	username string
+	password string
+	mu       sync.Mutex
+	basic    bool                     // the upstream uses basic auth
+	tokens   map[string]upstreamToken // by scope
+}
+
+func newTokenTransport(next http.RoundTripper, username, password string) *tokenTransport {
+	return &tokenTransport{
+		next:     next,
+		username: username,
+		password: password,
+		tokens:   map[string]upstreamToken{},
+	}
+}
+
+// RoundTrip sends the request with the cached credentials, and retries it once after answering the challenge.
+// Requests with a body can't be replayed, so they're retried only if the credentials were cached already
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scope := tokenScope(req)
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	t.authorize(req, scope)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return stripChallenge(resp), err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return stripChallenge(resp), nil
+	}
+
+	if err := t.answer(req.Context(), resp.Header.Get("WWW-Authenticate"), scope); err != nil {
+		return stripChallenge(resp), nil //nolint:nilerr // the upstream response is passed to the client
+	}
+	resp.Body.Close()
+	retry := req.Clone(req.Context())
+	t.authorize(retry, scope)
+	resp, err = t.next.RoundTrip(retry)
+	return stripChallenge(resp), err
+}
+
+// authorize sets the cached credentials of the scope
+func (t *tokenTransport) authorize(req *http.Request, scope string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.basic {
+		req.SetBasicAuth(t.username, t.password)
+		return
+	}
+	token, ok := t.tokens[scope]
+	if !ok {
+		return
+	}
+	if time.Now().Before(token.expires) {
+		req.Header.Set("Authorization", "Bearer "+token.value)
+		return
+	}
+	delete(t.tokens, scope)
+}
+
+// answer answers the challenge: switches to basic auth, or fetches the token and caches it for the scope
+func (t *tokenTransport) answer(ctx context.Context, challenge, scope string) error {
+	authScheme, rawParams, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(authScheme) {
+	case "basic":
+		if t.username == "" {
+			return fmt.Errorf("basic auth requires credentials")
+		}
+		t.mu.Lock()
+		t.basic = true
+		t.mu.Unlock()
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(rawParams, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	token, err := t.fetch(ctx, params)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// tokens of the scopes that aren't requested anymore are dropped, so the cache doesn't grow with the repositories
+	now := time.Now()
+	for other, otherToken := range t.tokens {
+		if !now.Before(otherToken.expires) {
+			delete(t.tokens, other)
+		}
+	}
+	t.tokens[scope] = token
+	return nil
+}
+
+// fetch requests the token from the realm of the challenge, see https://distribution.github.io/distribution/spec/auth/token/
+func (t *tokenTransport) fetch(ctx context.Context, params map[string]string) (upstreamToken, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return upstreamToken{}, fmt.Errorf("invalid realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, param := range []string{"service", "scope"} {
+		if params[param] != "" {
+			query.Set(param, params[param])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), http.NoBody)
+	if err != nil {
+		return upstreamToken{}, err
+	}
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return upstreamToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return upstreamToken{}, fmt.Errorf("token endpoint responded with %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return upstreamToken{}, err
+	}
+	token := upstreamToken{value: body.Token, expires: time.Now().Add(tokenDefaultTTL)}
+	if token.value == "" {
+		token.value = body.AccessToken
+	}
+	if token.value == "" {
+		return upstreamToken{}, fmt.Errorf("token endpoint responded without a token")
+	}
+	if body.ExpiresIn > 0 {
+		token.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	// the token must not expire in flight
+	token.expires = token.expires.Add(-time.Until(token.expires) / 10)
+	return token, nil
+}
+
+// tokenScope returns the scope of the request, e.g. repository:library/alpine:pull, used as the token cache key
+func tokenScope(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/v2/_catalog") {
+		return "registry:catalog:*"
+	}
+	repo := repository(req.URL.Path)
+	if repo == "" {
+		return ""
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return "repository:" + repo + ":pull"
+	}
+	return "repository:" + repo + ":pull,push"
+}
+
+// stripChallenge removes the upstream challenge from the response
+func stripChallenge(resp *http.Response) *http.Response {
+	if resp != nil {
+		resp.Header.Del("WWW-Authenticate")
+	}
+	return resp
+}
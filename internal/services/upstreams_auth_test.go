@@ -0,0 +1,49 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenTransportEvictsExpiredTokens(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"fresh","expires_in":300}`)) //nolint:errcheck // test server
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newTokenTransport(http.DefaultTransport, "", "")
+	transport.tokens["repository:old:pull"] = upstreamToken{value: "old", expires: time.Now().Add(-time.Second)}
+	transport.tokens["repository:other:pull"] = upstreamToken{value: "other", expires: time.Now().Add(-time.Second)}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/foo/manifests/latest", http.NoBody)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, the token is not used", resp.StatusCode)
+	}
+	if len(transport.tokens) != 1 || transport.tokens["repository:foo:pull"].value != "fresh" {
+		t.Errorf("cached tokens are %v, expected the fresh one only", transport.tokens)
+	}
+
+	// the expired token of the requested scope is dropped on lookup
+	transport.tokens["repository:old:pull"] = upstreamToken{value: "old", expires: time.Now().Add(-time.Second)}
+	transport.authorize(req.Clone(req.Context()), "repository:old:pull")
+	if _, ok := transport.tokens["repository:old:pull"]; ok {
+		t.Error("expired token is kept after the lookup")
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+)
+
+const (
+	// hubHost is the Docker Hub registry host
+	hubHost = "registry-1.docker.io"
+	// hubNamespace is the namespace of the official images, e.g. nginx is library/nginx
+	hubNamespace = "library"
+)
+
+// hubTransport tracks the pull rate limits of Docker Hub, reported in the ratelimit-limit and ratelimit-remaining
+// headers of the manifest responses, e.g. ratelimit-remaining: 76;w=21600
+type hubTransport struct {
+	next     http.RoundTripper
+	upstream string
+	log      *zerolog.Logger
+}
+
+func (t *hubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	limit, hasLimit := hubRateLimit(resp.Header.Get("Ratelimit-Limit"))
+	remaining, hasRemaining := hubRateLimit(resp.Header.Get("Ratelimit-Remaining"))
+	if !hasLimit || !hasRemaining {
+		return resp, nil
+	}
+	if remaining == 0 {
+		t.log.Warn().Str("upstream", t.upstream).Int("limit", limit).Msg("docker hub rate limit exhausted")
+	}
+	go metrics.UpstreamRateLimit(t.upstream, limit, remaining)
+	return resp, nil
+}
+
+// hubRateLimit parses the rate limit header value, e.g. 100;w=21600
+func hubRateLimit(value string) (int, bool) {
+	value, _, _ = strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	return n, err == nil
+}
+
+// hubNormalize adds the official images namespace to the short repository names in the client-facing path,
+// e.g. /v2/nginx/manifests/latest -> /v2/library/nginx/manifests/latest, taking the upstream prefix into account
+func hubNormalize(path, prefix string) string {
+	repo := repository(path)
+	if repo == "" {
+		return path
+	}
+	name, ok := strings.CutPrefix(repo, prefix+"/")
+	if prefix == "" || !ok { // routed by the host or by default
+		name, prefix = repo, ""
+	} else {
+		prefix += "/"
+	}
+	if strings.Contains(name, "/") {
+		return path
+	}
+	return "/v2/" + prefix + hubNamespace + "/" + name + strings.TrimPrefix(path, "/v2/"+repo)
+}
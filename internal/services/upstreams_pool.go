@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+)
+
+// UpstreamMember is a backend replica of the upstream pool
+type UpstreamMember struct {
+	Host     string
+	healthy  bool      // the result of the last active health check
+	failures int       // consecutive failures
+	ejected  time.Time // the member is not used until this time
+	active   int       // in-flight requests
+}
+
+// upstreamPool balances requests between the upstream members, skipping the unhealthy and ejected ones
+type upstreamPool struct {
+	name     string
+	scheme   string
+	balance  string
+	members  []*UpstreamMember
+	failures int
+	ejection time.Duration
+	mu       sync.Mutex
+	next     int // round-robin position
+}
+
+func newUpstreamPool(name string, target config.Target, cfg *config.Pool, log *zerolog.Logger) *upstreamPool {
+	pool := &upstreamPool{
+		name:     name,
+		scheme:   target.Scheme,
+		balance:  target.Balance,
+		failures: cfg.Failures,
+		ejection: time.Duration(cfg.Ejection) * time.Second,
+	}
+	switch pool.balance {
+	case "round-robin", "least-connections", "hash":
+	default:
+		log.Warn().Str("upstream", name).Str("balance", pool.balance).Msg("unsupported load-balancing strategy, using round-robin")
+		pool.balance = "round-robin"
+	}
+	for _, host := range append([]string{target.Host}, target.Members...) {
+		if host != "" {
+			pool.members = append(pool.members, &UpstreamMember{Host: host, healthy: true})
+		}
+	}
+	return pool
+}
+
+// available checks if the member is healthy and not ejected, must be called with the lock held
+func (p *upstreamPool) available(member *UpstreamMember) bool {
+	return member.healthy && time.Now().After(member.ejected)
+}
+
+// pick returns the member for the request, skipping the tried ones. If no member is available,
+// the first untried one is returned for the first attempt (the request fails anyway otherwise), and nil for failovers
+func (p *upstreamPool) pick(repository string, tried map[*UpstreamMember]bool) *UpstreamMember {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := make([]*UpstreamMember, 0, len(p.members))
+	for _, member := range p.members {
+		if !tried[member] && p.available(member) {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		if len(tried) > 0 || len(p.members) == 0 {
+			return nil
+		}
+		return p.members[0]
+	}
+
+	switch p.balance {
+	case "least-connections":
+		least := candidates[0]
+		for _, member := range candidates[1:] {
+			if member.active < least.active {
+				least = member
+			}
+		}
+		return least
+	case "hash":
+		// rendezvous hashing, so only the repositories of an ejected member move to the other ones
+		var best *UpstreamMember
+		var bestScore uint64
+		for _, member := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(member.Host + "/" + repository))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = member, score
+			}
+		}
+		return best
+	default:
+		p.next++
+		return candidates[p.next%len(candidates)]
+	}
+}
+
+// canFailover checks if there is an available member that wasn't tried yet
+func (p *upstreamPool) canFailover(tried map[*UpstreamMember]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, member := range p.members {
+		if !tried[member] && p.available(member) {
+			return true
+		}
+	}
+	return false
+}
+
+// start marks the request to the member as in-flight
+func (p *upstreamPool) start(member *UpstreamMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	member.active++
+}
+
+// done records the result of the request to the member, and ejects it after the consecutive failures
+func (p *upstreamPool) done(member *UpstreamMember, ok bool, log *zerolog.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	member.active--
+	if ok {
+		member.failures = 0
+		return
+	}
+	member.failures++
+	if len(p.members) > 1 && p.failures > 0 && member.failures >= p.failures && p.available(member) {
+		log.Warn().Str("upstream", p.name).Str("member", member.Host).Int("failures", member.failures).Str("period", p.ejection.String()).Msg("upstream member ejected")
+		member.ejected = time.Now().Add(p.ejection)
+		member.failures = 0
+		go metrics.UpstreamHealth(p.name, member.Host, false)
+	}
+}
+
+// check runs the active health checks periodically, a member is healthy if GET /v2/ responds with a non-5xx status
+// (401 is expected from registries with auth)
+func (p *upstreamPool) check(transport http.RoundTripper, interval, timeout time.Duration, log *zerolog.Logger) {
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, member := range p.members {
+			healthy := p.probe(client, member)
+
+			p.mu.Lock()
+			if healthy != member.healthy {
+				log.Info().Str("upstream", p.name).Str("member", member.Host).Bool("healthy", healthy).Msg("upstream member health changed")
+			}
+			member.healthy = healthy
+			available := p.available(member)
+			p.mu.Unlock()
+			go metrics.UpstreamHealth(p.name, member.Host, available)
+		}
+	}
+}
+
+func (p *upstreamPool) probe(client *http.Client, member *UpstreamMember) bool {
+	endpoint := url.URL{Scheme: p.scheme, Host: member.Host, Path: "/v2/"}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, endpoint.String(), http.NoBody)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// maxRedirects is the max amount of redirects followed for a single request
+const maxRedirects = 5
+
+// hubRedirectHosts are the redirect destinations of Docker Hub (CDN and storage), allowed by default in the hub mode
+var hubRedirectHosts = []string{"*.docker.com", "*.docker.io", "*.r2.cloudflarestorage.com"}
+
+// redirectTransport follows the redirects of read requests (e.g. blob GETs redirected to a CDN or a presigned S3/GCS URL),
+// so clients get the response from the proxy. Credentials are not passed to other hosts
+type redirectTransport struct {
+	next     http.RoundTripper
+	upstream string
+	hosts    map[string]bool // allowed redirect destinations: host:port, or host for any port
+	suffixes []string        // allowed wildcard destinations, e.g. .s3.amazonaws.com for *.s3.amazonaws.com
+	log      *zerolog.Logger
+}
+
+func newRedirectTransport(next http.RoundTripper, upstream string, hosts []string, log *zerolog.Logger) *redirectTransport {
+	exact := make([]string, 0, len(hosts))
+	suffixes := []string{}
+	for _, host := range hosts {
+		if suffix, ok := strings.CutPrefix(host, "*."); ok && !strings.Contains(suffix, "*") {
+			suffixes = append(suffixes, "."+suffix)
+			continue
+		}
+		if strings.Contains(host, "*") {
+			log.Error().Str("upstream", upstream).Str("host", host).Msg("invalid redirect destination, only *.example.com wildcards are supported, ignored")
+			continue
+		}
+		exact = append(exact, host)
+	}
+	return &redirectTransport{next: next, upstream: upstream, hosts: utils.NewMap(exact, true), suffixes: suffixes, log: log}
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return resp, err
+	}
+	digest := ""
+	if resp != nil {
+		digest = resp.Header.Get("Docker-Content-Digest")
+	}
+
+	current := req
+	for i := 0; err == nil && i < maxRedirects && isRedirect(resp.StatusCode); i++ {
+		location, lerr := resp.Location()
+		if lerr != nil {
+			return resp, nil //nolint:nilerr // the redirect is passed to the client
+		}
+		if !t.allowed(location) {
+			t.log.Warn().Str("upstream", t.upstream).Str("host", location.Hostname()).Msg("redirect destination is not allowed, passed to the client")
+			return resp, nil
+		}
+		if current.URL.Scheme == "https" && location.Scheme != "https" {
+			t.log.Warn().Str("upstream", t.upstream).Str("host", location.Hostname()).Msg("redirect to plain http is not followed, passed to the client")
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		follow := current.Clone(current.Context())
+		follow.URL = location
+		follow.Host = location.Host
+		follow.Body = nil
+		if location.Host != current.URL.Host {
+			follow.Header.Del("Authorization")
+		}
+		t.log.Debug().Str("upstream", t.upstream).Str("from", current.URL.Redacted()).Str("host", location.Host).Msg("following redirect")
+		current = follow
+		resp, err = t.next.RoundTrip(follow)
+	}
+	if err == nil && digest != "" && resp.Header.Get("Docker-Content-Digest") == "" {
+		// storages don't know the digest, but clients and the blobs cache rely on it
+		resp.Header.Set("Docker-Content-Digest", digest)
+	}
+	return resp, err
+}
+
+// allowed checks if the redirect destination is allowed: exact host (with or without port) or a wildcard (e.g. *.s3.amazonaws.com) match
+func (t *redirectTransport) allowed(location *url.URL) bool {
+	if t.hosts[location.Host] || t.hosts[location.Hostname()] {
+		return true
+	}
+	for _, suffix := range t.suffixes {
+		if strings.HasSuffix(location.Hostname(), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
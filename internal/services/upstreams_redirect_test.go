@@ -0,0 +1,99 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+// testRedirects starts the storage and the registry redirecting the blob requests to it
+func testRedirects(t *testing.T) (registry, storage *httptest.Server, auth *string) {
+	t.Helper()
+	auth = new(string)
+	storage = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*auth = r.Header.Get("Authorization")
+		w.Write([]byte("blob")) //nolint:errcheck // test server
+	}))
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:blob")
+		http.Redirect(w, r, storage.URL+"/presigned", http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(storage.Close)
+	t.Cleanup(registry.Close)
+	return registry, storage, auth
+}
+
+func TestRedirectTransport(t *testing.T) {
+	log := zerolog.Nop()
+	registry, storage, auth := testRedirects(t)
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+	storageHost := strings.TrimPrefix(storage.URL, "http://")
+
+	tests := map[string]struct {
+		target   config.Target
+		followed bool
+	}{
+		"default, other host":  {config.Target{Host: registryHost, FollowRedirects: true}, false},
+		"default, pool member": {config.Target{Host: registryHost, Members: []string{registryHost, storageHost}, FollowRedirects: true}, true},
+		"allowed host:port":    {config.Target{Host: registryHost, FollowRedirects: true, RedirectHosts: []string{storageHost}}, true},
+		"allowed host":         {config.Target{Host: registryHost, FollowRedirects: true, RedirectHosts: []string{"127.0.0.1"}}, true},
+		"not allowed":          {config.Target{Host: registryHost, FollowRedirects: true, RedirectHosts: []string{"*.s3.amazonaws.com"}}, false},
+		"allowed wildcard":     {config.Target{Host: registryHost, FollowRedirects: true, RedirectHosts: []string{"*.0.0.1"}}, true},
+		"invalid wildcard":     {config.Target{Host: registryHost, FollowRedirects: true, RedirectHosts: []string{"*0.0.1", "127.*"}}, false},
+	}
+	for name, test := range tests {
+		*auth = ""
+		transport := newUpstreamTransport("test", test.target, &config.Retry{}, http.DefaultTransport, &log)
+		req, _ := http.NewRequest(http.MethodGet, registry.URL+"/v2/foo/blobs/sha256:blob", http.NoBody)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp.Body.Close()
+
+		if !test.followed {
+			if resp.StatusCode != http.StatusTemporaryRedirect {
+				t.Errorf("%s: redirect followed to a not allowed host, status %d", name, resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: redirect not followed, status %d", name, resp.StatusCode)
+		}
+		if resp.Header.Get("Docker-Content-Digest") != "sha256:blob" {
+			t.Errorf("%s: digest of the redirecting response is lost", name)
+		}
+		if *auth != "" {
+			t.Errorf("%s: credentials sent to the other host", name)
+		}
+	}
+}
+
+func TestRedirectTransportRefusesDowngrade(t *testing.T) {
+	log := zerolog.Nop()
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("blob")) //nolint:errcheck // test server
+	}))
+	defer storage.Close()
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, storage.URL+"/presigned", http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	transport := newRedirectTransport(registry.Client().Transport, "test", []string{"127.0.0.1"}, &log)
+	req, _ := http.NewRequest(http.MethodGet, registry.URL+"/v2/foo/blobs/sha256:blob", http.NoBody)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("redirect from https to http is followed, status %d", resp.StatusCode)
+	}
+}
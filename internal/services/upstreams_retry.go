@@ -0,0 +1,135 @@
+package services
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// defaultRetryStatuses are the upstream response statuses retried by default
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// retryTransport retries the idempotent requests without a body (GET, HEAD) on connection errors and the configured statuses,
+// with exponential backoff and full jitter. Retries are limited by the budget, so they don't amplify the load during outages
+type retryTransport struct {
+	next       http.RoundTripper
+	upstream   string
+	max        int
+	statuses   map[int]bool
+	backoff    time.Duration
+	maxBackoff time.Duration
+	budget     *retryBudget
+	log        *zerolog.Logger
+}
+
+// retryBudget is a token bucket: each request adds the ratio of a token, each retry takes a whole token
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+	max    float64
+}
+
+func newRetryTransport(next http.RoundTripper, upstream string, cfg *config.Retry, log *zerolog.Logger) http.RoundTripper {
+	if cfg.Max <= 0 {
+		return next
+	}
+	statuses := cfg.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	// the bucket allows short bursts of retries, e.g. 10 tokens for the 20% budget
+	burst := float64(cfg.Budget) / 2
+	if burst < 1 {
+		burst = 1
+	}
+	return &retryTransport{
+		next:       next,
+		upstream:   upstream,
+		max:        cfg.Max,
+		statuses:   utils.NewMap(statuses, true),
+		backoff:    time.Duration(cfg.Backoff) * time.Millisecond,
+		maxBackoff: time.Duration(cfg.BackoffMax) * time.Millisecond,
+		budget:     &retryBudget{ratio: float64(cfg.Budget) / 100, tokens: burst, max: burst},
+		log:        log,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+	if !retryable {
+		return t.next.RoundTrip(req)
+	}
+
+	t.budget.deposit()
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if !t.failed(resp, err) || attempt >= t.max {
+			return resp, err
+		}
+		if !t.budget.withdraw() {
+			t.log.Warn().Str("upstream", t.upstream).Str("url", req.URL.String()).Msg("retry budget exhausted")
+			go metrics.UpstreamRetry(t.upstream, false)
+			return resp, err
+		}
+
+		delay := t.delay(attempt)
+		event := t.log.Warn().Err(err).Str("upstream", t.upstream).Str("url", req.URL.String()).Int("attempt", attempt+1).Str("backoff", delay.String())
+		if resp != nil {
+			event = event.Int("status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) //nolint:errcheck // the connection is reused if possible
+			resp.Body.Close()
+		}
+		event.Msg("upstream request failed, retrying")
+		go metrics.UpstreamRetry(t.upstream, true)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// failed checks if the request failed with a connection error or a retryable status
+func (t *retryTransport) failed(resp *http.Response, err error) bool {
+	return err != nil || t.statuses[resp.StatusCode]
+}
+
+// delay returns the backoff delay of the attempt: random between 0 and the exponential backoff (full jitter)
+func (t *retryTransport) delay(attempt int) time.Duration {
+	backoff := t.backoff << attempt
+	if backoff <= 0 || (t.maxBackoff > 0 && backoff > t.maxBackoff) {
+		backoff = t.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return rand.N(backoff) //nolint:gosec // jitter doesn't need a secure random
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.max, b.tokens+b.ratio)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+// tlsVersions are the supported values of the minimal TLS version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLS holds the CA bundle and the client certificate of the upstream,
+// the files are reloaded on the next handshake after they're changed (e.g. renewed certificates)
+type upstreamTLS struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	log      *zerolog.Logger
+
+	mu      sync.Mutex
+	caMod   time.Time
+	roots   *x509.CertPool
+	certMod time.Time
+	cert    *tls.Certificate
+}
+
+// upstreamTLSConfig returns the TLS config of the upstream, nil if the upstream doesn't have any TLS settings
+func upstreamTLSConfig(name string, target config.Target, log *zerolog.Logger) *tls.Config {
+	if target.TLSCA == "" && target.TLSCert == "" && target.TLSServerName == "" && target.TLSMinVersion == "" && !target.TLSInsecure {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: target.TLSServerName, MinVersion: tls.VersionTLS12} //nolint:gosec // the insecure mode is explicit
+	if target.TLSMinVersion != "" {
+		version, ok := tlsVersions[target.TLSMinVersion]
+		if !ok {
+			log.Error().Str("upstream", name).Str("version", target.TLSMinVersion).Msg("unsupported TLS version, using 1.2")
+			version = tls.VersionTLS12
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	files := &upstreamTLS{caFile: target.TLSCA, certFile: target.TLSCert, keyFile: target.TLSKey, log: log}
+	if target.TLSCert != "" {
+		if _, err := files.clientCertificate(nil); err != nil {
+			log.Error().Err(err).Str("upstream", name).Msg("cannot load the upstream client certificate")
+		}
+		tlsConfig.GetClientCertificate = files.clientCertificate
+	}
+	switch {
+	case target.TLSInsecure:
+		log.Warn().Str("upstream", name).Msg("upstream TLS certificates are not verified")
+		tlsConfig.InsecureSkipVerify = true
+	case target.TLSCA != "":
+		if _, err := files.rootCAs(); err != nil {
+			log.Error().Err(err).Str("upstream", name).Msg("cannot load the upstream CA bundle")
+		}
+		// the default verification doesn't support reloading the roots, so it's done in VerifyConnection
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = files.verifyConnection
+	}
+	return tlsConfig
+}
+
+// rootCAs returns the system roots with the CA bundle, reloaded if the file is changed
+func (t *upstreamTLS) rootCAs() (*x509.CertPool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.caFile)
+	if err != nil {
+		return t.roots, err
+	}
+	if t.roots != nil && info.ModTime().Equal(t.caMod) {
+		return t.roots, nil
+	}
+	bundle, err := os.ReadFile(t.caFile)
+	if err != nil {
+		return t.roots, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(bundle) {
+		return t.roots, fmt.Errorf("no certificates found in %s", t.caFile)
+	}
+	if t.roots != nil {
+		t.log.Info().Str("file", t.caFile).Msg("upstream CA bundle reloaded")
+	}
+	t.roots, t.caMod = roots, info.ModTime()
+	return roots, nil
+}
+
+// clientCertificate returns the client certificate, reloaded if the certificate file is changed
+func (t *upstreamTLS) clientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.certFile)
+	if err != nil {
+		return t.currentCert(err)
+	}
+	if t.cert != nil && info.ModTime().Equal(t.certMod) {
+		return t.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return t.currentCert(err)
+	}
+	if t.cert != nil {
+		t.log.Info().Str("file", t.certFile).Msg("upstream client certificate reloaded")
+	}
+	t.cert, t.certMod = &cert, info.ModTime()
+	return t.cert, nil
+}
+
+// currentCert returns the loaded certificate if the reload failed (e.g. the files are being replaced),
+// an empty certificate (nothing is sent) if there is none
+func (t *upstreamTLS) currentCert(err error) (*tls.Certificate, error) {
+	if t.cert != nil {
+		return t.cert, nil
+	}
+	return &tls.Certificate{}, err
+}
+
+// verifyConnection verifies the server certificate chain and name with the CA bundle
+func (t *upstreamTLS) verifyConnection(cs tls.ConnectionState) error {
+	roots, err := t.rootCAs()
+	if roots == nil {
+		return err
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("upstream didn't present a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+	})
+	return err
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+)
+
+// newTestTLSServer starts a TLS server recording the server names (SNI) of the clients
+func newTestTLSServer(t *testing.T) (server *httptest.Server, serverNames func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var names []string
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		names = append(names, hello.ServerName)
+		mu.Unlock()
+		return nil, nil
+	}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0) // the rejected handshakes are expected
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, names...)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	logger := zerolog.Nop()
+	upstream, upstreamNames := newTestTLSServer(t)
+	other, otherNames := newTestTLSServer(t)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	get := func(transport http.RoundTripper, url string) error {
+		req, _ := http.NewRequest(http.MethodGet, url+"/v2/", http.NoBody)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	target := config.Target{Host: strings.TrimPrefix(upstream.URL, "https://"), TLSCA: ca, TLSServerName: "example.com"}
+	transport, _ := newUpstreamHTTPTransport("test", target, &config.Transport{}, &logger)
+	if err := get(transport, upstream.URL); err != nil {
+		t.Errorf("upstream certificate is not verified with the CA bundle: %v", err)
+	}
+	if names := upstreamNames(); len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("upstream server names are %v, expected [example.com]", names)
+	}
+	// the other hosts (storage redirects, token realms) are verified with the system roots, without the server name override
+	if err := get(transport, other.URL); err == nil {
+		t.Error("other host certificate is verified with the upstream CA bundle")
+	}
+	if names := otherNames(); len(names) != 1 || names[0] != "" {
+		t.Errorf("other host server names are %v, expected no server name", names)
+	}
+
+	target.TLSServerName = "registry.test"
+	transport, _ = newUpstreamHTTPTransport("test", target, &config.Transport{}, &logger)
+	if err := get(transport, upstream.URL); err == nil {
+		t.Error("upstream certificate is accepted for the other server name")
+	}
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// connectTimeoutKey is the context key of the connect timeout of the request, used by the dialer
+type connectTimeoutKey struct{}
+
+// endpointTimeouts are the timeouts of an endpoint class, 0 for no timeout
+type endpointTimeouts struct {
+	connect time.Duration // connection establishment, including the TLS handshake
+	header  time.Duration // response headers, after the request is written
+	idle    time.Duration // response body, waiting for the upstream data
+}
+
+// timeoutTransport applies the timeouts of the endpoint class: metadata (manifests, tags, catalog),
+// blob downloads, and uploads (write requests)
+type timeoutTransport struct {
+	next     http.RoundTripper
+	metadata endpointTimeouts
+	blob     endpointTimeouts
+	upload   endpointTimeouts
+}
+
+// upstreamHostsTransport sends the requests to the upstream hosts (the host and the pool members) with the upstream TLS settings,
+// and the requests to other hosts (storage redirects, token realms) with the default ones
+type upstreamHostsTransport struct {
+	upstream *http.Transport
+	other    *http.Transport
+	hosts    map[string]bool
+}
+
+// newUpstreamHTTPTransport returns the base transport of the upstream: tuned connection pool, HTTP/2, TLS settings
+// (of the upstream hosts only), and the timeouts of the endpoint classes. The http.Transport of the upstream hosts
+// is returned as well, for the health checks
+func newUpstreamHTTPTransport(name string, target config.Target, cfg *config.Transport, log *zerolog.Logger) (http.RoundTripper, *http.Transport) {
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     !cfg.HTTP2Disabled,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.HTTP2Disabled {
+		// a non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	var next http.RoundTripper = transport
+	if tlsConfig := upstreamTLSConfig(name, target, log); tlsConfig != nil {
+		other := transport.Clone()
+		transport.TLSClientConfig = tlsConfig
+		next = &upstreamHostsTransport{
+			upstream: transport,
+			other:    other,
+			hosts:    utils.NewMap(append([]string{target.Host}, target.Members...), true),
+		}
+	}
+
+	return &timeoutTransport{
+		next:     next,
+		metadata: newEndpointTimeouts(cfg.Metadata),
+		blob:     newEndpointTimeouts(cfg.Blob),
+		upload:   newEndpointTimeouts(cfg.Upload),
+	}, transport
+}
+
+func (t *upstreamHostsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hosts[req.URL.Host] {
+		return t.upstream.RoundTrip(req)
+	}
+	return t.other.RoundTrip(req)
+}
+
+func newEndpointTimeouts(cfg config.Timeouts) endpointTimeouts {
+	return endpointTimeouts{
+		connect: time.Duration(cfg.Connect) * time.Second,
+		header:  time.Duration(cfg.Header) * time.Second,
+		idle:    time.Duration(cfg.Idle) * time.Second,
+	}
+}
+
+// timeouts returns the timeouts of the request's endpoint class
+func (t *timeoutTransport) timeouts(req *http.Request) endpointTimeouts {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.upload
+	}
+	if strings.Contains(req.URL.Path, "/blobs/") {
+		return t.blob
+	}
+	return t.metadata
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeouts := t.timeouts(req)
+	ctx, cancel := context.WithCancelCause(req.Context())
+	ctx = context.WithValue(ctx, connectTimeoutKey{}, timeouts.connect)
+
+	// the timer is started after the request is written, so uploads of large bodies don't count
+	timer := time.AfterFunc(time.Hour, func() {
+		cancel(fmt.Errorf("upstream response headers timeout (%s)", timeouts.header))
+	})
+	timer.Stop()
+	if timeouts.header > 0 {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				timer.Reset(timeouts.header)
+			},
+		})
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil && ctx.Err() != nil && req.Context().Err() == nil {
+			err = cause
+		}
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = newIdleTimeoutBody(resp.Body, timeouts.idle, cancel)
+	return resp, nil
+}
+
+// idleTimeoutBody cancels the request if a body read waits for the upstream longer than the idle timeout, e.g. a stalled blob transfer.
+// The time between reads isn't counted, so transfers to slow clients (the proxy doesn't read while it writes to them) aren't cancelled
+type idleTimeoutBody struct {
+	io.ReadCloser
+	idle   time.Duration
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, idle time.Duration, cancel context.CancelCauseFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, idle: idle, cancel: cancel}
+	if idle > 0 {
+		b.timer = time.AfterFunc(idle, func() {
+			cancel(fmt.Errorf("upstream response body idle timeout (%s)", idle))
+		})
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		return b.ReadCloser.Read(p)
+	}
+	b.timer.Reset(b.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	return n, err
+}
+
+// Close releases the request context, the connection is reused if the body was read fully
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
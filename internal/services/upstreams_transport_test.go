@@ -0,0 +1,47 @@
+package services
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallingReader returns the data in chunks, waiting before each of them
+type stallingReader struct {
+	data  *strings.Reader
+	delay time.Duration
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.data.Read(p[:1])
+}
+
+func TestIdleTimeoutBody(t *testing.T) {
+	idle := 20 * time.Millisecond
+
+	// a slow client reads with pauses longer than the idle timeout, the upstream isn't stalled
+	ctx, cancel := context.WithCancelCause(context.Background())
+	body := newIdleTimeoutBody(io.NopCloser(&stallingReader{data: strings.NewReader("abc")}), idle, cancel)
+	for {
+		time.Sleep(2 * idle)
+		if _, err := body.Read(make([]byte, 8)); err != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		t.Errorf("transfer to a slow client is cancelled: %v", context.Cause(ctx))
+	}
+	body.Close()
+
+	// the upstream is stalled
+	ctx, cancel = context.WithCancelCause(context.Background())
+	body = newIdleTimeoutBody(io.NopCloser(&stallingReader{data: strings.NewReader("abc"), delay: 3 * idle}), idle, cancel)
+	body.Read(make([]byte, 8)) //nolint:errcheck // the reader doesn't fail
+	if ctx.Err() == nil {
+		t.Error("stalled transfer is not cancelled")
+	}
+	body.Close()
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/etkecc/go-apm"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/etkecc/docker-registry-proxy/internal/config"
+	"github.com/etkecc/docker-registry-proxy/internal/metrics"
+	"github.com/etkecc/docker-registry-proxy/internal/utils"
+)
+
+// defaultWarmupAccept is the Accept header of the manifest requests, the same media types as docker and containerd send
+var defaultWarmupAccept = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// Warmup prefetches the configured images on startup and periodically, so the cache (and the blobs cache)
+// is populated before clients ask for them: /v2/, tag lists, manifests by tag (HEAD and GET),
+// manifests of the platforms by digest, and optionally config and layer blobs
+type Warmup struct {
+	images    []warmupImage
+	interval  time.Duration
+	accept    string
+	platforms map[string]bool
+	blobs     bool
+	log       *zerolog.Logger
+}
+
+type warmupImage struct {
+	repository string
+	pattern    string // tag glob pattern, see path.Match
+}
+
+// warmupRun is a single prefetch run of all images
+type warmupRun struct {
+	*Warmup
+	e       *echo.Echo
+	handler echo.HandlerFunc
+	seen    map[string]bool // fetched blobs
+	stats   warmupStats
+}
+
+type warmupStats struct {
+	tags      int
+	manifests int
+	blobs     int
+	failures  int
+}
+
+// NewWarmup returns a new Warmup instance, blobs are prefetched only if the blobs cache is enabled
+func NewWarmup(cfg *config.Warmup, blobs *Blobs, log *zerolog.Logger) *Warmup {
+	accept := cfg.Accept
+	if len(accept) == 0 {
+		accept = defaultWarmupAccept
+	}
+	warmup := &Warmup{
+		images:    make([]warmupImage, 0, len(cfg.Images)),
+		interval:  time.Duration(cfg.Interval) * time.Minute,
+		accept:    strings.Join(accept, ", "),
+		platforms: utils.NewMap(cfg.Platforms, true),
+		blobs:     cfg.Blobs && blobs.enabled,
+		log:       log,
+	}
+	if cfg.Blobs && !blobs.enabled {
+		log.Warn().Msg("blobs warm-up requires the blobs cache, only metadata will be prefetched")
+	}
+	for _, image := range cfg.Images {
+		repository, pattern, _ := strings.Cut(image, ":")
+		if pattern == "" {
+			pattern = "*"
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Error().Err(err).Str("image", image).Msg("invalid warm-up tag pattern, skipping")
+			continue
+		}
+		warmup.images = append(warmup.images, warmupImage{repository: repository, pattern: pattern})
+	}
+	return warmup
+}
+
+// Start prefetches the images in the background on startup, and then periodically if the interval is set.
+// Requests are passed to the handler directly (the proxy behind the cache middlewares), so they bypass the auth
+func (w *Warmup) Start(e *echo.Echo, handler echo.HandlerFunc) {
+	if len(w.images) == 0 {
+		return
+	}
+
+	go func() {
+		w.run(e, handler)
+		if w.interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.run(e, handler)
+		}
+	}()
+}
+
+func (w *Warmup) run(e *echo.Echo, handler echo.HandlerFunc) {
+	started := time.Now()
+	w.log.Info().Int("images", len(w.images)).Msg("cache warm-up started")
+	run := &warmupRun{Warmup: w, e: e, handler: handler, seen: map[string]bool{}}
+	run.fetch(http.MethodGet, "/v2/", "", false)
+	for _, image := range w.images {
+		run.image(image)
+	}
+
+	w.log.Info().
+		Int("tags", run.stats.tags).
+		Int("manifests", run.stats.manifests).
+		Int("blobs", run.stats.blobs).
+		Int("failures", run.stats.failures).
+		Str("took", time.Since(started).String()).
+		Msg("cache warm-up finished")
+	go metrics.WarmupFinished(time.Since(started))
+}
+
+// image prefetches the tag list of the repository and manifests of the matching tags
+func (r *warmupRun) image(image warmupImage) {
+	before := r.stats
+	_, body, ok := r.fetch(http.MethodGet, "/v2/"+image.repository+"/tags/list", "", true)
+	if !ok {
+		return
+	}
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		r.log.Warn().Err(err).Str("repository", image.repository).Msg("cannot parse tag list")
+		return
+	}
+
+	for _, tag := range list.Tags {
+		if ok, _ := path.Match(image.pattern, tag); ok { //nolint:errcheck // the pattern is validated
+			r.stats.tags++
+			r.manifest(image.repository, tag, true)
+		}
+	}
+	r.log.Info().
+		Str("repository", image.repository).
+		Str("pattern", image.pattern).
+		Int("tags", r.stats.tags-before.tags).
+		Int("manifests", r.stats.manifests-before.manifests).
+		Int("blobs", r.stats.blobs-before.blobs).
+		Int("failures", r.stats.failures-before.failures).
+		Msg("cache warm-up: image prefetched")
+}
+
+// manifest prefetches the manifest, manifests of its platforms (if it's an index), and blobs (if enabled).
+// HEAD requests are sent for tags only, as clients use them to check the tag digest
+func (r *warmupRun) manifest(repository, reference string, tag bool) {
+	endpoint := "/v2/" + repository + "/manifests/" + reference
+	if tag {
+		r.fetch(http.MethodHead, endpoint, r.accept, false)
+	}
+	_, body, ok := r.fetch(http.MethodGet, endpoint, r.accept, true)
+	if !ok {
+		return
+	}
+	r.stats.manifests++
+
+	var manifest struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		r.log.Warn().Err(err).Str("url", endpoint).Msg("cannot parse manifest")
+		return
+	}
+
+	for _, child := range manifest.Manifests {
+		platform := child.Platform.OS + "/" + child.Platform.Architecture
+		if len(r.platforms) > 0 && !r.platforms[platform] && !r.platforms[platform+"/"+child.Platform.Variant] {
+			continue
+		}
+		r.manifest(repository, child.Digest, false)
+	}
+
+	if !r.blobs {
+		return
+	}
+	digests := []string{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, digest := range digests {
+		if digest != "" && !r.seen[digest] {
+			r.seen[digest] = true
+			r.blob(repository, digest)
+		}
+	}
+}
+
+// blob prefetches the blob, unless it's cached already (the HEAD request marks it as recently used)
+func (r *warmupRun) blob(repository, digest string) {
+	endpoint := "/v2/" + repository + "/blobs/" + digest
+	headers, _, ok := r.fetch(http.MethodHead, endpoint, "", false)
+	if !ok {
+		return
+	}
+	if headers.Get("X-Cache") != "HIT" {
+		if _, _, ok = r.fetch(http.MethodGet, endpoint, "", false); !ok {
+			return
+		}
+	}
+	r.stats.blobs++
+}
+
+// fetch passes the request to the handler, returns the response headers and the body (if keep is true)
+func (r *warmupRun) fetch(method, endpoint, accept string, keep bool) (http.Header, []byte, bool) {
+	req, err := http.NewRequestWithContext(apm.NewContext(), method, endpoint, http.NoBody)
+	if err != nil {
+		r.log.Warn().Err(err).Str("url", endpoint).Msg("cannot create warm-up request")
+		r.stats.failures++
+		return nil, nil, false
+	}
+	req.Header.Set("User-Agent", "docker-registry-proxy/warmup")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	w := &bufferWriter{discardWriter: discardWriter{header: http.Header{}}, keep: keep}
+	c := r.e.NewContext(req, w)
+	err = r.handler(c)
+	if status := c.Response().Status; err != nil || status != http.StatusOK {
+		r.log.Warn().Err(err).Str("method", method).Str("url", endpoint).Int("status", status).Msg("warm-up request failed")
+		r.stats.failures++
+		go metrics.Warmup(false)
+		return nil, nil, false
+	}
+	go metrics.Warmup(true)
+	return c.Response().Header(), w.body.Bytes(), true
+}